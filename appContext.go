@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Everything an invocation needs to talk to the database: this gets made
+// once in main and passed down, so we only read the config file and open
+// a connection once per run.
+type appContext struct {
+	config  *DBConfig
+	dialect dbDialect
+	db      *gorm.DB
+	stores  map[string]attachmentStore
+	// When this run started, which is what "now" and "today" mean for the
+	//  rest of it: see dates.go
+	now time.Time
+}
+
+func newAppContext(configFilename string, debug bool) (*appContext, error) {
+	dbConfig, err := parseDBConfig(configFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	dialect, err := getDialect(dbConfig.DBType)
+	if err != nil {
+		return nil, classify(exitConfig, err)
+	}
+
+	db, err := gorm.Open(dialect.DriverName(), dialect.ConnectionString(dbConfig.DBConnectionString))
+	if err != nil {
+		return nil, dbError(fmt.Errorf("could not connect to database: %s", err))
+	}
+
+	if debug {
+		db = db.Debug()
+	}
+
+	return &appContext{
+		config:  dbConfig,
+		dialect: dialect,
+		db:      db,
+		stores:  newAttachmentStores(dbConfig),
+		now:     time.Now(),
+	}, nil
+}
+
+func (ac *appContext) Close() {
+	ac.db.Close()
+}
+
+// Runs fn with a copy of the context whose db is a transaction, committing
+// if fn succeeds and rolling back if it doesn't, so that each command
+// either happens completely or not at all.
+//
+// Try not to do anything slow or interactive (like opening an editor) inside
+// fn once it has touched the database: depending on the database, other
+// people's commands may have to wait for us to finish.
+func (ac *appContext) inTransaction(fn func(tx *appContext) error) error {
+	return ac.inTransactionWith(nil, fn)
+}
+
+// Runs fn in a transaction that only reads, and in which every query sees
+// the database as it was when the first one ran, even if other people's
+// changes are committed in the meantime, so that something that reads
+// everything, like a backup, gets a consistent copy. (PostgreSQL would
+// otherwise let each query see whatever had been committed before it ran.)
+func (ac *appContext) inReadTransaction(fn func(tx *appContext) error) error {
+	return ac.inTransactionWith(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}, fn)
+}
+
+func (ac *appContext) inTransactionWith(options *sql.TxOptions, fn func(tx *appContext) error) (err error) {
+	tx := ac.db.BeginTx(context.Background(), options)
+	if tx.Error != nil {
+		return dbError(tx.Error)
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	txContext := *ac
+	txContext.db = tx
+	err = fn(&txContext)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		return dbError(err)
+	}
+	committed = true
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The helpers the other tests share: an appContext with a fresh in-memory
+// SQLite database behind it, and a way to see what a command printed.
+
+// settings are extra config file entries, like `"timezone": "Europe/London"`.
+func newTestAppContext(t *testing.T, now time.Time, settings ...string) *appContext {
+	t.Helper()
+	config := `{"db_type": "sqlite3", "db_connection_string": ":memory:"`
+	for _, v := range settings {
+		config += ", " + v
+	}
+	config += "}"
+	configFilename := filepath.Join(t.TempDir(), "exceptions_db.conf")
+	err := ioutil.WriteFile(configFilename, []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := newAppContext(configFilename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ac.Close)
+	// Every connection to :memory: gets a database of its own
+	ac.db.DB().SetMaxOpenConns(1)
+	ac.db.LogMode(false)
+	ac.now = now
+
+	err = createDB(ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac
+}
+
+// Runs fn, returning everything it printed to stdout.
+func captureStdout(t *testing.T, fn func() error) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		printed, _ := ioutil.ReadAll(reader)
+		output <- string(printed)
+	}()
+
+	err = fn()
+	writer.Close()
+	printed := <-output
+	if err != nil {
+		t.Fatal(err)
+	}
+	return printed
+}
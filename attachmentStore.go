@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Where the contents of attached files live. Each FormFile records which
+// store its contents went to in Storage, so changing attachment_store in the
+// config file only affects new files: existing ones stay where they are
+// until they're moved with `form migrate-storage`.
+//
+// What gets stored is whatever compressForStorage handed back, so the stores
+// never need to know about compression.
+type attachmentStore interface {
+	// The name recorded in FormFile.Storage
+	Name() string
+	// Stores contents for file, and sets its Storage, StorageKey and
+	// FileContents to say where they went
+	Put(file *FormFile, stored []byte) error
+	// Returns what Put stored for file
+	Get(file *FormFile) ([]byte, error)
+	// Removes whatever is stored under key: the caller has to check that no
+	// other file is using it first, since the content-addressed stores keep
+	// only one copy of identical contents
+	Delete(key string) error
+}
+
+const (
+	storageDatabase  = "database"
+	storageDirectory = "directory"
+	storageS3        = "s3"
+)
+
+var storageNames = []string{storageDatabase, storageDirectory, storageS3}
+
+// Makes every store the config file has settings for, not just the one new
+// files go into, so that files already in the others can still be read.
+func newAttachmentStores(config *DBConfig) map[string]attachmentStore {
+	stores := map[string]attachmentStore{
+		storageDatabase: databaseStore{},
+	}
+	if config.AttachmentDirectory != "" {
+		stores[storageDirectory] = directoryStore{dir: config.AttachmentDirectory}
+	}
+	if config.S3 != nil {
+		stores[storageS3] = &s3Store{config: *config.S3, client: &http.Client{Timeout: 5 * time.Minute}}
+	}
+	return stores
+}
+
+// The store a file's contents are in. Files attached before there was a
+// choice of stores have no Storage, and are all in the database.
+func (ac *appContext) storeFor(storage string) (attachmentStore, error) {
+	if storage == "" {
+		storage = storageDatabase
+	}
+	store, ok := ac.stores[storage]
+	if !ok {
+		return nil, configErrorf("files are stored in %q, but the config file has no settings for it", storage)
+	}
+	return store, nil
+}
+
+// The store new files go into.
+func (ac *appContext) defaultStore() (attachmentStore, error) {
+	return ac.storeFor(ac.config.AttachmentStore)
+}
+
+// The contents of a file as stored, i.e. still compressed if they are.
+func (ac *appContext) storedContents(file *FormFile) ([]byte, error) {
+	store, err := ac.storeFor(file.Storage)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := store.Get(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file %d from %s storage: %s", file.ID, store.Name(), err)
+	}
+	return stored, nil
+}
+
+// The contents of the file as they were attached, decompressed if need be.
+func (ac *appContext) fileContents(file *FormFile) ([]byte, error) {
+	stored, err := ac.storedContents(file)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := decompress(stored, file.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress file %d: %s", file.ID, err)
+	}
+	return contents, nil
+}
+
+// The original: contents go in the FileContents column.
+type databaseStore struct{}
+
+func (databaseStore) Name() string { return storageDatabase }
+
+func (databaseStore) Put(file *FormFile, stored []byte) error {
+	file.Storage = storageDatabase
+	file.StorageKey = ""
+	file.FileContents = stored
+	return nil
+}
+
+func (databaseStore) Get(file *FormFile) ([]byte, error) {
+	return file.FileContents, nil
+}
+
+// Clearing FileContents is all it takes, which the caller does anyway.
+func (databaseStore) Delete(key string) error {
+	return nil
+}
+
+// The SHA-256 of what's stored, which is all the content-addressed stores
+// need to find it again.
+func storageKeyFor(stored []byte) string {
+	return sha256Hex(stored)
+}
+
+// Keeps each file's contents in dir/ab/abcdef..., named by storageKeyFor, so
+// identical contents are only stored once. Only readable by whoever attached
+// them, like the backups, since they're everyone's forms.
+type directoryStore struct {
+	dir string
+}
+
+func (directoryStore) Name() string { return storageDirectory }
+
+func (store directoryStore) path(key string) (string, error) {
+	// Keys come from the database, so make sure nobody has slipped in a ../
+	if len(key) != 64 || strings.Trim(key, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("%q is not a valid storage key", key)
+	}
+	return filepath.Join(store.dir, key[:2], key), nil
+}
+
+func (store directoryStore) Put(file *FormFile, stored []byte) error {
+	key := storageKeyFor(stored)
+	target, err := store.path(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(target)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(target), 0700)
+		if err != nil {
+			return fmt.Errorf("could not create attachment directory: %s", err)
+		}
+		// Written under another name first and then renamed, so there's
+		//  never a half-written file under the real name
+		tempFile, err := ioutil.TempFile(filepath.Dir(target), ".incoming-")
+		if err != nil {
+			return fmt.Errorf("could not write to attachment directory: %s", err)
+		}
+		_, err = tempFile.Write(stored)
+		if err == nil {
+			err = tempFile.Close()
+		}
+		if err == nil {
+			err = os.Rename(tempFile.Name(), target)
+		}
+		if err != nil {
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+			return fmt.Errorf("could not write to attachment directory: %s", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("could not check attachment directory: %s", err)
+	}
+
+	file.Storage = storageDirectory
+	file.StorageKey = key
+	file.FileContents = nil
+	return nil
+}
+
+func (store directoryStore) Get(file *FormFile) ([]byte, error) {
+	source, err := store.path(file.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(source)
+}
+
+func (store directoryStore) Delete(key string) error {
+	target, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Settings for an S3-compatible object store, from the "s3" section of the
+// config file. Objects are addressed path-style (endpoint/bucket/key), which
+// everything that claims to be S3-compatible understands.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` // e.g. "https://s3.eu-west-2.amazonaws.com"
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region"` // Defaults to "us-east-1", which most non-AWS stores expect
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Prefix    string `json:"prefix"` // Put in front of every object name, e.g. "forms/"
+}
+
+// Keeps each file's contents as an object named by storageKeyFor, like
+// directoryStore. Requests are signed with AWS Signature Version 4, done by
+// hand here rather than pulling in an SDK for three kinds of request.
+type s3Store struct {
+	config S3Config
+	client *http.Client
+}
+
+func (*s3Store) Name() string { return storageS3 }
+
+func (store *s3Store) Put(file *FormFile, stored []byte) error {
+	key := storageKeyFor(stored)
+	_, err := store.do("PUT", key, stored)
+	if err != nil {
+		return err
+	}
+	file.Storage = storageS3
+	file.StorageKey = key
+	file.FileContents = nil
+	return nil
+}
+
+func (store *s3Store) Get(file *FormFile) ([]byte, error) {
+	if file.StorageKey == "" {
+		return nil, fmt.Errorf("no storage key recorded")
+	}
+	return store.do("GET", file.StorageKey, nil)
+}
+
+func (store *s3Store) Delete(key string) error {
+	_, err := store.do("DELETE", key, nil)
+	return err
+}
+
+func (store *s3Store) do(method string, key string, body []byte) ([]byte, error) {
+	url := strings.TrimSuffix(store.config.Endpoint, "/") + "/" + store.config.Bucket + "/" + store.config.Prefix + key
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	store.sign(request, body, time.Now().UTC())
+
+	response, err := store.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s", method, url, response.Status)
+	}
+	return responseBody, nil
+}
+
+func (store *s3Store) sign(request *http.Request, body []byte, now time.Time) {
+	region := store.config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		"host:" + request.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := []byte("AWS4" + store.config.SecretKey)
+	for _, v := range []string{day, region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, v)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		store.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Moves every file that isn't in the given store (or the default one, if
+// that's "") into it. Files are moved one at a time, and each is checked
+// against its checksum before it goes anywhere, so if this is interrupted
+// or a file is damaged, every file is still readable from one store or the
+// other and it can just be run again.
+func migrateStorage(ac *appContext, to string) error {
+	var target attachmentStore
+	var err error
+	if to == "" {
+		target, err = ac.defaultStore()
+	} else {
+		target, err = ac.storeFor(to)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Soft-deleted files too, so nothing is left behind in the old store
+	var fileIDs []uint
+	err = ac.db.Unscoped().Model(&FormFile{}).
+		Where("storage <> ? OR storage IS NULL", target.Name()).
+		Order("id").
+		Pluck("id", &fileIDs).Error
+	if err != nil {
+		return dbError(err)
+	}
+
+	moved, bad := 0, 0
+	for _, id := range fileIDs {
+		file := &FormFile{}
+		err = ac.db.Unscoped().First(file, id).Error
+		if err != nil {
+			return dbError(err)
+		}
+		problem := verifyFile(ac, file)
+		if problem != "" {
+			log.Printf("Not moving file %d (%s): %s", file.ID, file.FileName, problem)
+			bad++
+			continue
+		}
+		if file.SHA256 == "" {
+			log.Printf("Warning: moving file %d (%s), which has %s.", file.ID, file.FileName, noChecksumWarning)
+		}
+
+		source, err := ac.storeFor(file.Storage)
+		if err != nil {
+			return err
+		}
+		stored, err := ac.storedContents(file)
+		if err != nil {
+			return err
+		}
+		oldKey := file.StorageKey
+
+		err = target.Put(file, stored)
+		if err != nil {
+			return fmt.Errorf("could not move file %d to %s storage: %s", file.ID, target.Name(), err)
+		}
+		err = ac.db.Unscoped().Model(file).UpdateColumns(map[string]interface{}{
+			"storage":       file.Storage,
+			"storage_key":   file.StorageKey,
+			"file_contents": file.FileContents,
+		}).Error
+		if err != nil {
+			return dbError(err)
+		}
+
+		// Identical files share what's stored in the content-addressed
+		//  stores, so only remove it once nothing else is using it
+		if oldKey != "" {
+			var users int
+			err = ac.db.Unscoped().Model(&FormFile{}).
+				Where("storage = ? AND storage_key = ?", source.Name(), oldKey).
+				Count(&users).Error
+			if err != nil {
+				return dbError(err)
+			}
+			if users == 0 {
+				err = source.Delete(oldKey)
+				if err != nil {
+					log.Printf("Warning: file %d was moved, but could not be removed from %s storage: %s", file.ID, source.Name(), err)
+				}
+			}
+		}
+		moved++
+	}
+
+	log.Printf("Moved %d files to %s storage.", moved, target.Name())
+	if bad != 0 {
+		return classify(exitInconsistent, fmt.Errorf("%d files failed verification and were not moved", bad))
+	}
+	return nil
+}
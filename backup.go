@@ -0,0 +1,486 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A backup is a gzipped tar file containing:
+//   - exceptions.json: a --no-files dump of everything, including anything
+//     that's been soft-deleted
+//   - files/<ID>: the contents of each attached file, by FormFile ID, exactly
+//     as stored (so compressed, if the file's Compression says so), from
+//     whichever attachmentStore they're in: restoring puts them all into
+//     the one new files would go into
+//   - manifest.json: what's in the backup, with the size and SHA-256 of
+//     each of the above
+//
+// The manifest goes last, since the checksums aren't known until everything
+// else has been written, so anything reading a backup has to get to the end
+// of it before it knows whether what it read was any good.
+const backupFormatVersion = 1
+
+const (
+	backupDumpName     = "exceptions.json"
+	backupManifestName = "manifest.json"
+	backupFilesDir     = "files/"
+)
+
+type backupManifest struct {
+	FormatVersion int           `json:"format_version"`
+	SchemaVersion int           `json:"schema_version"`
+	ToolCommit    string        `json:"tool_commit"`
+	CreatedAt     time.Time     `json:"created_at"`
+	Counts        recordCounts  `json:"counts"`
+	Entries       []backupEntry `json:"entries"`
+}
+
+type backupEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// For backups that are damaged, incomplete, or otherwise not what their
+// manifest says they are.
+func backupProblemf(format string, args ...interface{}) error {
+	return classify(exitInconsistent, fmt.Errorf(format, args...))
+}
+
+func backup(ac *appContext, filename string) (err error) {
+	// Backups have everyone's forms in, so they're only readable by us, and
+	//  we never overwrite an old one
+	archiveFile, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("could not create backup file: %s", err)
+	}
+	defer func() {
+		closeErr := archiveFile.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
+
+	gzipWriter := gzip.NewWriter(archiveFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	manifest := backupManifest{
+		FormatVersion: backupFormatVersion,
+		SchemaVersion: schemaVersion,
+		ToolCommit:    commitLabel,
+		CreatedAt:     time.Now(),
+	}
+
+	// Everything is read in one transaction, so that the backup is of the
+	//  database as it was at one moment, even if someone else changes it
+	//  while we're reading
+	var counts recordCounts
+	err = ac.inReadTransaction(func(tx *appContext) error {
+		var err error
+		counts, err = writeBackupContents(tx, tarWriter, &manifest)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return err
+	}
+	_, err = addBackupEntry(tarWriter, backupManifestName, int64(len(manifestBytes)), bytes.NewReader(manifestBytes))
+	if err != nil {
+		return err
+	}
+
+	err = tarWriter.Close()
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("could not write backup file: %s", err)
+	}
+
+	log.Printf("Backed up %s to %s.", counts, filename)
+	return nil
+}
+
+// Adds the dump and the files to the backup, and their entries to the
+// manifest. Soft-deleted exceptions, comments, files etc are included, with
+// their DeletedAt, since they can still be recovered.
+func writeBackupContents(ac *appContext, tarWriter *tar.Writer, manifest *backupManifest) (recordCounts, error) {
+	// tar needs to know how big each entry is before it's written, so the
+	//  dump has to go somewhere else first
+	dumpFile, err := ioutil.TempFile("", "exceptions-backup-*.json")
+	if err != nil {
+		return recordCounts{}, fmt.Errorf("could not create temporary file: %s", err)
+	}
+	defer os.Remove(dumpFile.Name())
+	defer dumpFile.Close()
+
+	dumpWriter := bufio.NewWriter(dumpFile)
+	counts, fileIDs, err := writeDump(ac, dumpWriter, true, "", "", true)
+	if err != nil {
+		return counts, err
+	}
+	err = dumpWriter.Flush()
+	if err != nil {
+		return counts, fmt.Errorf("could not write temporary file: %s", err)
+	}
+	manifest.Counts = counts
+
+	dumpSize, err := dumpFile.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = dumpFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return counts, fmt.Errorf("could not read temporary file: %s", err)
+	}
+
+	entry, err := addBackupEntry(tarWriter, backupDumpName, dumpSize, dumpFile)
+	if err != nil {
+		return counts, err
+	}
+	manifest.Entries = append(manifest.Entries, entry)
+
+	// One at a time, so only one file is ever in memory
+	for _, id := range fileIDs {
+		file := &FormFile{}
+		err = ac.db.Unscoped().First(file, id).Error
+		if err != nil {
+			return counts, dbError(err)
+		}
+		stored, err := ac.storedContents(file)
+		if err != nil {
+			return counts, err
+		}
+		entry, err = addBackupEntry(tarWriter, backupFilesDir+fmt.Sprint(id), int64(len(stored)), bytes.NewReader(stored))
+		if err != nil {
+			return counts, err
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+	return counts, nil
+}
+
+func addBackupEntry(tarWriter *tar.Writer, path string, size int64, contents io.Reader) (backupEntry, error) {
+	err := tarWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path,
+		Size:     size,
+		Mode:     0600,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return backupEntry{}, fmt.Errorf("could not write backup file: %s", err)
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tarWriter, hash), contents)
+	if err != nil {
+		return backupEntry{}, fmt.Errorf("could not write backup file: %s", err)
+	}
+
+	return backupEntry{Path: path, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// The only things a backup should have in it: this also stops anything
+// we extract from ending up outside the directory we extract it into.
+func isValidBackupPath(path string) bool {
+	if path == backupDumpName || path == backupManifestName {
+		return true
+	}
+	if !strings.HasPrefix(path, backupFilesDir) {
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimPrefix(path, backupFilesDir), 10, 0)
+	return err == nil
+}
+
+// Reads a whole backup, checking every entry against the manifest, and
+// returns the manifest if everything matches. If extractTo is set, the
+// dump is written out into that directory as it's read, along with the
+// files if withFiles is set.
+func readBackup(filename string, extractTo string, withFiles bool) (*backupManifest, error) {
+	archiveFile, err := os.Open(filename)
+	if err != nil {
+		return nil, validationErrorf("could not open backup: %s", err)
+	}
+	defer archiveFile.Close()
+
+	gzipReader, err := gzip.NewReader(archiveFile)
+	if err != nil {
+		return nil, backupProblemf("%s is not a backup: %s", filename, err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	if extractTo != "" && withFiles {
+		err = os.Mkdir(filepath.Join(extractTo, backupFilesDir), 0700)
+		if err != nil {
+			return nil, fmt.Errorf("could not create temporary directory: %s", err)
+		}
+	}
+
+	var manifest *backupManifest
+	found := make(map[string]backupEntry)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, backupProblemf("backup %s is damaged: %s", filename, err)
+		}
+		// We don't write an entry for the files directory, but tar does if
+		//  someone's unpacked and repacked a backup
+		if header.Typeflag == tar.TypeDir && header.Name == backupFilesDir {
+			continue
+		}
+		if !isValidBackupPath(header.Name) || header.Typeflag != tar.TypeReg {
+			return nil, backupProblemf("backup %s contains something unexpected: %s", filename, header.Name)
+		}
+
+		hash := sha256.New()
+		var destination io.Writer = hash
+		var manifestBuffer bytes.Buffer
+		var extracted *os.File
+		if header.Name == backupManifestName {
+			destination = io.MultiWriter(hash, &manifestBuffer)
+		} else if extractTo != "" && (withFiles || header.Name == backupDumpName) {
+			extracted, err = os.OpenFile(filepath.Join(extractTo, header.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return nil, fmt.Errorf("could not extract %s from backup: %s", header.Name, err)
+			}
+			destination = io.MultiWriter(hash, extracted)
+		}
+
+		size, err := io.Copy(destination, tarReader)
+		if extracted != nil {
+			closeErr := extracted.Close()
+			if err == nil && closeErr != nil {
+				return nil, fmt.Errorf("could not extract %s from backup: %s", header.Name, closeErr)
+			}
+		}
+		if err != nil {
+			return nil, backupProblemf("backup %s is damaged: %s", filename, err)
+		}
+		found[header.Name] = backupEntry{Path: header.Name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}
+
+		if header.Name == backupManifestName {
+			manifest = &backupManifest{}
+			err = json.Unmarshal(manifestBuffer.Bytes(), manifest)
+			if err != nil {
+				return nil, backupProblemf("backup %s has a damaged manifest: %s", filename, err)
+			}
+		}
+	}
+
+	if manifest == nil {
+		return nil, backupProblemf("backup %s has no manifest: it may be incomplete", filename)
+	}
+	if manifest.FormatVersion > backupFormatVersion {
+		return nil, validationErrorf("backup %s is in backup format version %d, but this version of the tool only understands up to %d: use a newer version", filename, manifest.FormatVersion, backupFormatVersion)
+	}
+
+	var problems []string
+	listed := make(map[string]bool)
+	for _, expected := range manifest.Entries {
+		listed[expected.Path] = true
+		actual, ok := found[expected.Path]
+		switch {
+		case !ok:
+			problems = append(problems, expected.Path+" is missing")
+		case actual.Size != expected.Size:
+			problems = append(problems, fmt.Sprintf("%s is %d bytes, should be %d", expected.Path, actual.Size, expected.Size))
+		case actual.SHA256 != expected.SHA256:
+			problems = append(problems, expected.Path+" does not match its checksum")
+		}
+	}
+	for path := range found {
+		if !listed[path] && path != backupManifestName {
+			problems = append(problems, path+" is not in the manifest")
+		}
+	}
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return nil, backupProblemf("backup %s failed verification:\n  %s", filename, strings.Join(problems, "\n  "))
+	}
+
+	return manifest, nil
+}
+
+// Files with no checksum of their own can only be checked against the
+// manifest, which restore accepts with a warning, so verify points them out
+// too.
+func verifyBackup(filename string) error {
+	extractTo, err := ioutil.TempDir("", "exceptions-verify-")
+	if err != nil {
+		return fmt.Errorf("could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(extractTo)
+
+	manifest, err := readBackup(filename, extractTo, false)
+	if err != nil {
+		return err
+	}
+	unchecked, err := filesWithoutChecksums(filepath.Join(extractTo, backupDumpName))
+	if err != nil {
+		return err
+	}
+	toolCommit := manifest.ToolCommit
+	if toolCommit == "" {
+		toolCommit = "(unknown)"
+	}
+	fmt.Printf("Backup of %s, made %s by commit %s (schema version %d).\n",
+		manifest.Counts, manifest.CreatedAt.Format("2006-01-02 15:04:05"), toolCommit, manifest.SchemaVersion)
+	fmt.Printf("All %d entries match their checksums.\n", len(manifest.Entries))
+	for _, file := range unchecked {
+		fmt.Printf("Warning: file %d (%s) has %s.\n", file.ID, file.FileName, noChecksumWarning)
+	}
+	return nil
+}
+
+// The files in an extracted dump that have no checksum recorded.
+func filesWithoutChecksums(dumpFilename string) ([]FormFile, error) {
+	dumpFile, err := os.Open(dumpFilename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read extracted backup: %s", err)
+	}
+	defer dumpFile.Close()
+
+	reader, err := newDumpReader(dumpFile)
+	if err != nil {
+		return nil, err
+	}
+	var unchecked []FormFile
+	for {
+		exception, err := reader.Next()
+		if err == io.EOF {
+			return unchecked, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range exception.FormFiles {
+			if file.SHA256 == "" {
+				unchecked = append(unchecked, file)
+			}
+		}
+	}
+}
+
+// Checks the whole backup before touching the database, and then restores
+// it in a single transaction, so the database ends up with either all of
+// the backup or none of it.
+func restore(ac *appContext, filename string) error {
+	extractTo, err := ioutil.TempDir("", "exceptions-restore-")
+	if err != nil {
+		return fmt.Errorf("could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(extractTo)
+
+	manifest, err := readBackup(filename, extractTo, true)
+	if err != nil {
+		return err
+	}
+	if manifest.SchemaVersion > schemaVersion {
+		return validationErrorf("backup is from schema version %d, but this version of the tool only understands up to %d: use a newer version to restore it", manifest.SchemaVersion, schemaVersion)
+	}
+
+	var restored recordCounts
+	err = ac.inTransaction(func(tx *appContext) error {
+		for _, model := range allModels {
+			var count int
+			err := tx.db.Unscoped().Model(model).Count(&count).Error
+			if err != nil {
+				return dbError(err)
+			}
+			if count != 0 {
+				return validationErrorf("the database is not empty: restore only restores into an empty database (use importjson to merge into one that isn't)")
+			}
+		}
+
+		dumpFile, err := os.Open(filepath.Join(extractTo, backupDumpName))
+		if err != nil {
+			return fmt.Errorf("could not read extracted backup: %s", err)
+		}
+		defer dumpFile.Close()
+
+		reader, err := newDumpReader(dumpFile)
+		if err != nil {
+			return err
+		}
+
+		db := keepingTimestamps(tx.db)
+		store, err := tx.defaultStore()
+		if err != nil {
+			return err
+		}
+		for {
+			exception, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			for i := range exception.FormFiles {
+				file := &exception.FormFiles[i]
+				file.FileContents, err = ioutil.ReadFile(filepath.Join(extractTo, backupFilesDir, fmt.Sprint(file.ID)))
+				var contents []byte
+				if err == nil {
+					contents, err = decompress(file.FileContents, file.Compression)
+				}
+				if err != nil || (file.SHA256 != "" && sha256Hex(contents) != file.SHA256) {
+					return backupProblemf("backup does not have the right contents for file %d", file.ID)
+				}
+				if file.SHA256 == "" {
+					log.Printf("Warning: file %d (%s) has %s.", file.ID, file.FileName, noChecksumWarning)
+				}
+			}
+
+			// The database is empty, so there's nothing for "replace" to
+			//  replace: it just means nothing gets looked up first
+			_, _, err = importOne(db, store, exception, "replace", false)
+			if err != nil {
+				return err
+			}
+			restored.add(exception)
+		}
+
+		err = syncIDSequences(tx.dialect, db)
+		if err != nil {
+			return err
+		}
+
+		if restored != manifest.Counts {
+			return backupProblemf("restored %s, but the backup's manifest says it has %s", restored, manifest.Counts)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restored %s.", restored)
+	return nil
+}
@@ -22,8 +22,14 @@ var (
 
 	homeDir = os.Getenv("HOME")
 
-	configFile    = app.Flag("config", "Path to config file").Default(homeDir + "/.exceptions_db.conf").String()
+	configFile    = app.Flag("config", "Path to config file").Default(homeDir + "/.exceptions_db.conf").Envar("EXCEPTIONS_CONFIG").String()
 	gormDebugMode = app.Flag("ormdebug", "Enable ORM debugging output").Bool()
+	colorMode     = app.Flag("color", "Colour the output: auto (only on a terminal, and only if NO_COLOR isn't set), always or never.").Default("auto").Enum("auto", "always", "never")
+	// For testing what happens at particular times, e.g. when the clocks change
+	pretendNow = app.Flag("now", "Act as though it's this time (RFC 3339) instead of now").Hidden().String()
+	// Set by the zsh and fish completion scripts, which can show a description
+	//  with each suggestion, as "value<tab>description": see completion.go
+	completionDescriptions = app.Flag("completion-descriptions", "Add descriptions to completions").Hidden().Bool()
 
 	listCmd      = app.Command("list", "List entries")
 	submitCmd    = app.Command("submit", "Submit a new exception")
@@ -35,57 +41,78 @@ var (
 	deleteCmd    = app.Command("delete", "Delete an existing exception.")
 	formCmd      = app.Command("form", "Handle the exception form files")
 	//	editCmd      = app.Command("edit", "Edit an existing exception")
-	commentCmd = app.Command("comment", "Add a comment to an existing exception")
+	commentCmd = app.Command("comment", "Add, list, edit and delete comments on exceptions")
 	detailsCmd = app.Command("details", "View all details for an exception").Alias("info").Alias("detail")
 	renewCmd   = app.Command("renew", "[Not Yet Implemented] Adds time onto an existing exception.")
 
 	reportCmd = app.Command("report", "Generates a summary report for the week. Gives lists of IDs for exceptions that are undecided, waiting for implementation, waiting to be removed, expiring within 5 days, expiring within 14 days.")
 
-	jsonDumpCmd   = app.Command("dumpjson", "Full-structured dump of all exceptions as JSON.")
-	jsonImportCmd = app.Command("importjson", "Import an array of exceptions as JSON.")
+	jsonDumpCmd   = app.Command("dumpjson", "Full-structured dump of exceptions as JSON.")
+	jsonImportCmd = app.Command("importjson", "Import exceptions from a JSON dump (optionally gzipped) on standard input.")
+
+	backupCmd  = app.Command("backup", "Back up everything in the DB, including attached files, to a single compressed file")
+	restoreCmd = app.Command("restore", "Restore a backup made with the backup command into an empty DB")
 
 	createDBCmd    = app.Command("createdb", "Create the exceptions DB")
+	upgradeDBCmd   = app.Command("upgradedb", "Add any tables and columns that newer versions of this tool need to an existing exceptions DB")
 	destroyDBCmd   = app.Command("destroydb", "Destroy the exceptions DB")
+	fsckCmd        = app.Command("fsck", "Check the exceptions DB for inconsistencies, and optionally repair them")
 	makeNoodlesCmd = app.Command("makenoodles", "Insert some sample data to the database (for development)").Hidden()
 	examplesCmd    = app.Command("examples", "Show some examples of use")
+	completionCmd  = app.Command("completion", "Print a shell completion script, e.g. for `source <(exceptions completion bash)`")
 
-	// Need these to make default dates below
-	//  Could also make default nil and generate in-function, but have not done that. No particular reason.
-	now                     = time.Now()
-	nowPlusYear             = time.Now().AddDate(1, 0, 0)
-	dateTodayString         = stringFromDate(&now)
-	dateTodayPlusYearString = stringFromDate(&nowPlusYear)
-
-	submitName            = submitCmd.Flag("username", "Username exception applies to.").Required().String()
-	submitDate            = submitCmd.Flag("submitted", "Date exception was submitted to us. [today]").Default(dateTodayString).String()
-	submitStartDate       = submitCmd.Flag("starts", "Date exception should start. [today]").Default(dateTodayString).String()
-	submitEndDate         = submitCmd.Flag("ends", "Date exception should finish. [today plus a year]").Default(dateTodayPlusYearString).String()
+	submitName            = submitCmd.Flag("username", "Username exception applies to (required unless using --from-form).").String()
+	submitDate            = submitCmd.Flag("submitted", "Date exception was submitted to us. [today]").Default("today").String()
+	submitStartDate       = submitCmd.Flag("starts", "Date exception should start. [today]").Default("today").String()
+	submitEndDate         = submitCmd.Flag("ends", "Date exception should finish; relative dates like +6m count from --starts. [today plus a year]").String()
 	submitExceptionDetail = submitCmd.Flag("detail", "Detail of the exception: quota size, queue length, etc.").Default("5TB Scratch").String()
 	submitWithForm        = submitCmd.Flag("form", "Attach a form immediately.").String()
 	submitWithComment     = submitCmd.Flag("comment", "Add a comment immediately.").Short('c').String()
 	submitWithEditComment = submitCmd.Flag("edit-comment", "Open editor to add a comment immediately.").Short('C').Bool()
+	submitFromForm        = submitCmd.Flag("from-form", "Read the details from a filled-in request form or email (see `form template`), and attach it. Anything the form leaves out comes from the other options.").String()
+	submitAssumeYes       = submitCmd.Flag("yes", "Don't ask for confirmation of what was read from --from-form.").Short('y').Bool()
+	submitInteractive     = submitCmd.Flag("interactive", "Ask for each part of the exception in turn, using the other options as defaults.").Short('i').Bool()
+	submitForce           = submitCmd.Flag("force", "Submit even if the dates break the rules: starting after ending, submitted in the future, or lasting longer than max_durations allows.").Short('f').Bool()
+	submitAllowOverlap    = submitCmd.Flag("allow-overlap", "Submit even if the user already has an exception of the same type on the same service for some of the same dates.").Bool()
 
 	// The validation strings are set in submitFilters.go
 	submitService = submitCmd.Flag("service",
 		"Which service the exception applies to. ("+
 			validServicesString+
-			")").Default("myriad").String()
+			")").Default("myriad").HintOptions(validServices...).String()
 	submitExceptionType = submitCmd.Flag("type",
 		"What type of exception it is. ("+
 			validExceptionTypesString+
-			")").Default("quota").String()
+			")").Default("quota").HintOptions(validExceptionTypes...).String()
 
-	listOpts      = []string{"all", "undecided", "approved", "rejected", "needed", "active", "implemented", "removed", "overdue", "pending", "inconsistent", "todo"}
+	listOpts      = []string{"all", "undecided", "approved", "rejected", "needed", "active", "implemented", "removed", "overdue", "pending", "inconsistent", "todo", "overlapping"}
 	listHelp      = fmt.Sprintf("Class of exception to list (%s)", strings.Join(listOpts, ", "))
 	listClassEnum = listCmd.Arg("class", listHelp).Default("all").Enum(listOpts...)
 
 	// This is 'c' for cluster to match the jobhist tool
 	listService = listCmd.Flag("service", "List only for one service").Short('c').String()
 
-	attachSubcmd        = formCmd.Command("attach", "Attach a file to an exception.")
-	downloadSubcmd      = formCmd.Command("download", "Download a file by file ID.")
-	downloadForExSubcmd = formCmd.Command("download-for", "Download all files for an exception.")
-	filelistSubcmd      = formCmd.Command("list", "List attached files for an exception.")
+	// Any date dates.go understands, and not including the date itself
+	listStartsAfter  = listCmd.Flag("starts-after", "List only exceptions starting after this date").String()
+	listStartsBefore = listCmd.Flag("starts-before", "List only exceptions starting before this date").String()
+	listEndsAfter    = listCmd.Flag("ends-after", "List only exceptions ending after this date").String()
+	listEndsBefore   = listCmd.Flag("ends-before", "List only exceptions ending before this date, e.g. --ends-before=+2w").String()
+
+	attachSubcmd         = formCmd.Command("attach", "Attach a file to an exception.")
+	downloadSubcmd       = formCmd.Command("download", "Download a file by file ID.")
+	downloadForExSubcmd  = formCmd.Command("download-for", "Download all files for an exception.")
+	filelistSubcmd       = formCmd.Command("list", "List attached files for an exception.")
+	formRemoveSubcmd     = formCmd.Command("remove", "Remove an attached file.")
+	formReplaceSubcmd    = formCmd.Command("replace", "Attach a new version of a file, keeping the old one as history.")
+	formTemplateSubcmd   = formCmd.Command("template", "Print the request form for people to fill in, which submit --from-form can read.")
+	verifySubcmd         = formCmd.Command("verify", "Check stored files against their checksums.")
+	migrateStorageSubcmd = formCmd.Command("migrate-storage", "Move the contents of attached files from wherever they are into one store.")
+
+	commentAddSubcmd    = commentCmd.Command("add", "Add a comment to an existing exception (the default).").Default()
+	commentListSubcmd   = commentCmd.Command("list", "List the comments on an exception.")
+	commentReplySubcmd  = commentCmd.Command("reply", "Reply to a comment.")
+	commentEditSubcmd   = commentCmd.Command("edit", "Edit a comment, keeping the old version as history.")
+	commentDeleteSubcmd = commentCmd.Command("delete", "Delete a comment.")
 
 	undecideID  = undecideCmd.Arg("id", "").Required().Uint()
 	approveID   = approveCmd.Arg("id", "").Required().Uint()
@@ -104,8 +131,18 @@ var (
 	downloadID    = downloadSubcmd.Arg("id", "file ID").Required().Uint()
 	downloadForID = downloadForExSubcmd.Arg("id", "exception ID").Required().Uint()
 	filelistID    = filelistSubcmd.Arg("id", "").Required().Uint()
+	formRemoveID  = formRemoveSubcmd.Arg("file-id", "file ID").Required().Uint()
+	formReplaceID = formReplaceSubcmd.Arg("file-id", "file ID").Required().Uint()
+	verifyID      = verifySubcmd.Arg("id", "exception ID [all files]").Uint()
+
+	downloadOutputDir    = downloadSubcmd.Flag("output-dir", "Directory to write the file to.").Short('o').Default(".").String()
+	downloadOverwrite    = downloadSubcmd.Flag("overwrite", "Overwrite a file that's already there, instead of picking a new name.").Bool()
+	downloadStdout       = downloadSubcmd.Flag("stdout", "Write the file's contents to stdout instead.").Bool()
+	downloadForOutputDir = downloadForExSubcmd.Flag("output-dir", "Directory to write the files to.").Short('o').Default(".").String()
+	downloadForOverwrite = downloadForExSubcmd.Flag("overwrite", "Overwrite files that are already there, instead of picking new names.").Bool()
+	downloadForZip       = downloadForExSubcmd.Flag("zip", "Write all the files into one zip file, exception-ID.zip.").Bool()
 	//	editID        = editCmd.Arg("id", "").Required().Uint()
-	commentID = commentCmd.Arg("id", "").Required().Uint()
+	commentID = commentAddSubcmd.Arg("id", "").Required().Uint()
 	detailsID = detailsCmd.Arg("id", "").Required().Uint()
 
 	// approveApprover = approveCmd.Arg("approver", "Name of the user approving (or 'CRAG')").Required().String()
@@ -113,9 +150,43 @@ var (
 	// //  ^-- Might change these to default to a config file setting later
 	// Changed model so that username is always approver or rejecter -- even if CRAG did the actual approving policy-wise
 
-	commentTextArg = commentCmd.Flag("comment", "Comment text -- if not provided, an editor will open for input").Short('c').Default("").String()
+	commentTextArg = commentAddSubcmd.Flag("comment", "Comment text -- if not provided, an editor will open for input").Short('c').Default("").String()
+
+	commentListID      = commentListSubcmd.Arg("id", "exception ID").Required().Uint()
+	commentListHistory = commentListSubcmd.Flag("history", "Include the old versions of edited comments.").Bool()
+	commentReplyID     = commentReplySubcmd.Arg("comment-id", "comment ID").Required().Uint()
+	commentReplyText   = commentReplySubcmd.Flag("comment", "Reply text -- if not provided, an editor will open for input").Short('c').Default("").String()
+	commentEditID      = commentEditSubcmd.Arg("comment-id", "comment ID").Required().Uint()
+	commentEditText    = commentEditSubcmd.Flag("comment", "New comment text -- if not provided, an editor will open with the existing text").Short('c').Default("").String()
+	commentDeleteID    = commentDeleteSubcmd.Arg("comment-id", "comment ID").Required().Uint()
+
+	migrateStorageTo = migrateStorageSubcmd.Flag("to", "Store to move files into ("+strings.Join(storageNames, ", ")+") [attachment_store from the config file]").Enum(storageNames...)
+
+	attachFilename       = attachSubcmd.Arg("filename", "").Required().String()
+	attachAllowDuplicate = attachSubcmd.Flag("allow-duplicate", "Attach the file even if the exception already has an identical one.").Bool()
+	attachDescription    = attachSubcmd.Flag("description", "What the file is, e.g. \"renewal form\".").Short('d').String()
+	filelistHistory      = filelistSubcmd.Flag("history", "Include old versions of files that have been replaced.").Bool()
 
-	attachFilename = attachSubcmd.Arg("filename", "").Required().String()
+	formReplaceFilename    = formReplaceSubcmd.Arg("filename", "").Required().String()
+	formReplaceDescription = formReplaceSubcmd.Flag("description", "What the file is [the old version's description]").Short('d').String()
+
+	jsonDumpNoFiles = jsonDumpCmd.Flag("no-files", "Leave out the contents of attached files, giving a SHA-256 checksum of each instead.").Bool()
+	jsonDumpSince   = jsonDumpCmd.Flag("since", "Only dump exceptions that have been created or changed (including their comments, files, etc) since this date (e.g. 2026-03-01, -30d, start-of-term).").String()
+	jsonDumpIDs     = jsonDumpCmd.Flag("ids", "Only dump these exceptions (comma-separated IDs).").String()
+
+	backupCreateSubcmd = backupCmd.Command("create", "Make a new backup (the default).").Default()
+	backupVerifySubcmd = backupCmd.Command("verify", "Check that a backup is complete and undamaged (doesn't need the DB).")
+	backupFile         = backupCreateSubcmd.Arg("file", "File to write the backup to. [exceptions-backup.(today).tar.gz]").String()
+	backupVerifyFile   = backupVerifySubcmd.Arg("file", "Backup to check.").Required().String()
+	restoreFile        = restoreCmd.Arg("file", "Backup to restore.").Required().String()
+
+	jsonImportMode   = jsonImportCmd.Flag("mode", "What to do with exceptions whose IDs are already in the database ("+strings.Join(importModes, ", ")+")").Default("merge").Enum(importModes...)
+	jsonImportDryRun = jsonImportCmd.Flag("dry-run", "Show what would change, without changing anything.").Bool()
+
+	completionShell = completionCmd.Arg("shell", "Which shell to complete for (bash, zsh, fish)").Required().Enum("bash", "zsh", "fish")
+
+	fsckFix   = fsckCmd.Flag("fix", "Repair what can be repaired, recording an audit entry for each repair.").Bool()
+	fsckTrust = fsckCmd.Flag("trust", "When an exception's status and its status history disagree, which one to believe (history, status)").Default("history").Enum("history", "status")
 
 	// The other way to do the list suboptions
 	//nlistCmd = app.Command("nlist", "List entries")
@@ -127,105 +198,348 @@ func main() {
 	if userIsServiceUser() {
 		log.Fatal("Do not run this as a service user/role account.")
 	}
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+
+	command, err := app.Parse(os.Args[1:])
+	if err != nil {
+		app.Errorf("%s, try --help", err)
+		os.Exit(exitUsage)
+	}
+	useColor = colorWanted(*colorMode)
+
+	err = runCommand(command)
+	if err != nil {
+		log.Print("Error: ", err)
+		os.Exit(exitCodeFor(err))
+	}
+}
+
+// Split out from main so that the deferred Close happens before we exit
+func runCommand(command string) error {
+	// These are the only things that don't need the database
+	switch command {
+	case examplesCmd.FullCommand():
+		printExamples()
+		return nil
+	case backupVerifySubcmd.FullCommand():
+		return verifyBackup(*backupVerifyFile)
+	case formTemplateSubcmd.FullCommand():
+		printFormTemplate()
+		return nil
+	case completionCmd.FullCommand():
+		fmt.Print(completionScript(*completionShell))
+		return nil
+	}
+
+	ac, err := newAppContext(*configFile, *gormDebugMode)
+	if err != nil {
+		return err
+	}
+	defer ac.Close()
+	if *pretendNow != "" {
+		ac.now, err = time.Parse(time.RFC3339, *pretendNow)
+		if err != nil {
+			return usageErrorf("could not parse --now time %q (should be RFC 3339, e.g. 2026-03-29T00:30:00Z)", *pretendNow)
+		}
+	}
+
+	// Anything that changes the database goes through ac.inTransaction,
+	//  so that a command either happens completely or not at all.
+	switch command {
 	case listCmd.FullCommand():
-		list(*listClassEnum)
+		return list(ac, *listClassEnum)
 	case reportCmd.FullCommand():
-		report()
+		return report(ac)
 	case submitCmd.FullCommand():
 		if (*submitWithComment != "") && (*submitWithEditComment == true) {
-			log.Fatal("Please only specify one comment mechanism.")
-		}
-		id, err := submitWithAllParts(*submitName,
-			*submitDate,
-			*submitStartDate,
-			*submitEndDate,
-			*submitService,
-			*submitExceptionType,
-			*submitExceptionDetail)
-		if err != nil {
-			log.Fatal(err)
+			return usageErrorf("please only specify one comment mechanism")
 		}
-		log.Printf("Exception %d created.", id)
-
-		var formID uint
-		if *submitWithForm != "" {
-			formID, err = attach(id, *submitWithForm)
+		if *submitFromForm != "" {
+			if *submitWithForm != "" {
+				return usageErrorf("--from-form already attaches the form, so it can't be used with --form")
+			}
+			if *submitInteractive {
+				return usageErrorf("--from-form and --interactive can't be used together")
+			}
+			fields, err := parseForm(*submitFromForm, ac.dateParser())
 			if err != nil {
-				log.Fatal(err)
-			} else {
-				log.Printf("File %d attached to exception %d.", formID, id)
+				return err
 			}
-		}
-
-		var newCommentID uint
-		if *submitWithComment != "" {
-			newCommentID, err = comment(id, *submitWithComment)
+			err = fields.fillInAndCheck(ac.dateParser(), *submitName, *submitService, *submitExceptionType, *submitExceptionDetail, *submitDate, *submitStartDate, *submitEndDate)
+			if err != nil {
+				return err
+			}
+			err = fields.checkBeforeConfirming(ac, *submitAllowOverlap, *submitForce)
 			if err != nil {
-				log.Fatal(err)
-			} else {
-				log.Printf("Comment %d added to exception %d.", newCommentID, id)
+				return err
+			}
+			confirmed, err := confirmSubmission(fields, *submitFromForm, *submitAssumeYes)
+			if err != nil {
+				return err
+			}
+			if !confirmed {
+				log.Print("Nothing submitted.")
+				return nil
+			}
+			*submitName, *submitService, *submitExceptionType, *submitExceptionDetail = fields.Username, fields.Service, fields.Type, fields.Detail
+			*submitDate, *submitStartDate, *submitEndDate = fields.Submitted, fields.Starts, fields.Ends
+			*submitWithForm = *submitFromForm
+		} else if *submitInteractive {
+			fields, err := askForSubmission(ac.dateParser(), &submissionFields{
+				Username:  *submitName,
+				Service:   *submitService,
+				Type:      *submitExceptionType,
+				Detail:    *submitExceptionDetail,
+				Submitted: *submitDate,
+				Starts:    *submitStartDate,
+				Ends:      *submitEndDate,
+			})
+			if err != nil {
+				return err
+			}
+			err = fields.checkBeforeConfirming(ac, *submitAllowOverlap, *submitForce)
+			if err != nil {
+				return err
+			}
+			confirmed, err := confirmSubmission(fields, *submitWithForm, false)
+			if err != nil {
+				return err
+			}
+			if !confirmed {
+				log.Print("Nothing submitted.")
+				return nil
+			}
+			*submitName, *submitService, *submitExceptionType, *submitExceptionDetail = fields.Username, fields.Service, fields.Type, fields.Detail
+			*submitDate, *submitStartDate, *submitEndDate = fields.Submitted, fields.Starts, fields.Ends
+
+			// Only asked about if they weren't given as options already
+			if *submitWithComment == "" && !*submitWithEditComment && *submitWithForm == "" {
+				*submitWithComment, *submitWithForm, err = askForCommentAndForm(fields)
+				if err != nil {
+					return err
+				}
 			}
+		} else if *submitName == "" {
+			return usageErrorf("required flag --username not provided")
 		}
+		commentText := *submitWithComment
 		if *submitWithEditComment == true {
-			newCommentID, err = comment(id, "")
+			fields := &submissionFields{Username: *submitName, Service: *submitService, Type: *submitExceptionType,
+				Detail: *submitExceptionDetail, Starts: *submitStartDate, Ends: *submitEndDate}
+			commentText, err = getTextFromEditor("", fields.commentEditorSummary())
 			if err != nil {
-				log.Fatal(err)
-			} else {
-				log.Printf("Comment %d added to exception %d.", newCommentID, id)
+				return err
 			}
 		}
+
+		var id, formID, newCommentID uint
+		err = ac.inTransaction(func(tx *appContext) error {
+			var err error
+			id, err = submitWithAllParts(tx,
+				*submitName,
+				*submitDate,
+				*submitStartDate,
+				*submitEndDate,
+				*submitService,
+				*submitExceptionType,
+				*submitExceptionDetail,
+				*submitAllowOverlap,
+				*submitForce)
+			if err != nil {
+				return err
+			}
+
+			if *submitWithForm != "" {
+				formID, err = attach(tx, id, *submitWithForm, false, "")
+				if err != nil {
+					return err
+				}
+			}
+
+			if commentText != "" {
+				newCommentID, err = comment(tx, id, commentText)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Exception %d created.", id)
+		if formID != 0 {
+			log.Printf("File %d attached to exception %d.", formID, id)
+		}
+		if newCommentID != 0 {
+			log.Printf("Comment %d added to exception %d.", newCommentID, id)
+		}
 	case undecideCmd.FullCommand():
-		undecide(*undecideID, *undecideForceFlag)
+		return ac.inTransaction(func(tx *appContext) error { return undecide(tx, *undecideID, *undecideForceFlag) })
 	case approveCmd.FullCommand():
-		approve(*approveID, *approveForceFlag)
+		return ac.inTransaction(func(tx *appContext) error { return approve(tx, *approveID, *approveForceFlag) })
 	case rejectCmd.FullCommand():
-		reject(*rejectID, *rejectForceFlag)
+		return ac.inTransaction(func(tx *appContext) error { return reject(tx, *rejectID, *rejectForceFlag) })
 	case implementCmd.FullCommand():
-		implement(*implementID, *implementForceFlag)
+		return ac.inTransaction(func(tx *appContext) error { return implement(tx, *implementID, *implementForceFlag) })
 	case removeCmd.FullCommand():
-		remove(*removeID, *removeForceFlag)
+		return ac.inTransaction(func(tx *appContext) error { return remove(tx, *removeID, *removeForceFlag) })
 	case deleteCmd.FullCommand():
-		edelete(*deleteID) // Delete is a keeeeyword, oops
+		return ac.inTransaction(func(tx *appContext) error { return edelete(tx, *deleteID) }) // Delete is a keeeeyword, oops
 	case attachSubcmd.FullCommand():
-		newAttachmentID, err := attach(*attachID, *attachFilename)
+		var newAttachmentID uint
+		err = ac.inTransaction(func(tx *appContext) error {
+			var err error
+			newAttachmentID, err = attach(tx, *attachID, *attachFilename, *attachAllowDuplicate, *attachDescription)
+			return err
+		})
 		if err != nil {
-			log.Fatal(err)
-		} else {
-			log.Printf("File %d attached to exception %d.", newAttachmentID, *attachID)
+			return err
 		}
+		log.Printf("File %d attached to exception %d.", newAttachmentID, *attachID)
 	case downloadSubcmd.FullCommand():
-		downloadOneFile(*downloadID)
+		return downloadOneFile(ac, *downloadID, downloadOptions{outputDir: *downloadOutputDir, overwrite: *downloadOverwrite, stdout: *downloadStdout})
 	case downloadForExSubcmd.FullCommand():
-		downloadFilesForException(*downloadForID)
+		return downloadFilesForException(ac, *downloadForID, downloadOptions{outputDir: *downloadForOutputDir, overwrite: *downloadForOverwrite, zip: *downloadForZip})
 	case filelistSubcmd.FullCommand():
-		listFilesForException(*filelistID)
+		return listFilesForException(ac, *filelistID, *filelistHistory)
+	case formRemoveSubcmd.FullCommand():
+		err = ac.inTransaction(func(tx *appContext) error { return removeFile(tx, *formRemoveID) })
+		if err != nil {
+			return err
+		}
+		log.Printf("File %d removed.", *formRemoveID)
+	case formReplaceSubcmd.FullCommand():
+		var newFileID uint
+		err = ac.inTransaction(func(tx *appContext) error {
+			var err error
+			newFileID, err = replaceFile(tx, *formReplaceID, *formReplaceFilename, *formReplaceDescription)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("File %d replaced by file %d.", *formReplaceID, newFileID)
+	case verifySubcmd.FullCommand():
+		return verifyFiles(ac, *verifyID)
+	case migrateStorageSubcmd.FullCommand():
+		return migrateStorage(ac, *migrateStorageTo)
 		//	case editCmd.FullCommand():
 		//		edit(*editID)
-	case commentCmd.FullCommand():
-		newCommentID, err := comment(*commentID, *commentTextArg)
+	case commentAddSubcmd.FullCommand():
+		// Check there's something to comment on before making anyone write a comment
+		exception, err := GetException(ac.db, *commentID)
+		if err != nil {
+			return err
+		}
+		commentText, err := commentTextFromArgOrEditor(*commentTextArg, commentEditorSummary(exception))
+		if err != nil {
+			return err
+		}
+
+		var newCommentID uint
+		err = ac.inTransaction(func(tx *appContext) error {
+			var err error
+			newCommentID, err = comment(tx, *commentID, commentText)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Comment %d added to exception %d.", newCommentID, *commentID)
+	case commentListSubcmd.FullCommand():
+		return listCommentsForException(ac, *commentListID, *commentListHistory)
+	case commentReplySubcmd.FullCommand():
+		parent, err := getComment(ac.db, *commentReplyID)
+		if err != nil {
+			return err
+		}
+		about, err := replyEditorSummary(ac.db, parent)
+		if err != nil {
+			return err
+		}
+		replyText, err := commentTextFromArgOrEditor(*commentReplyText, about)
+		if err != nil {
+			return err
+		}
+		var newCommentID uint
+		err = ac.inTransaction(func(tx *appContext) error {
+			var err error
+			newCommentID, err = replyToComment(tx, parent.ID, replyText)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Comment %d added to exception %d, replying to comment %d.", newCommentID, parent.ExceptionID, parent.ID)
+	case commentEditSubcmd.FullCommand():
+		existing, err := getComment(ac.db, *commentEditID)
+		if err != nil {
+			return err
+		}
+		newText := *commentEditText
+		if newText == "" {
+			exception, err := GetException(ac.db, existing.ExceptionID)
+			if err != nil {
+				return err
+			}
+			newText, err = getTextFromEditor(existing.CommentText, commentEditorSummary(exception))
+			if err != nil {
+				return err
+			}
+		}
+		err = ac.inTransaction(func(tx *appContext) error {
+			return editComment(tx, existing.ID, newText)
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Comment %d edited.", existing.ID)
+	case commentDeleteSubcmd.FullCommand():
+		err = ac.inTransaction(func(tx *appContext) error {
+			return deleteComment(tx, *commentDeleteID)
+		})
 		if err != nil {
-			log.Fatal(err)
-		} else {
-			log.Printf("Comment %d added to exception %d.", newCommentID, *commentID)
+			return err
 		}
+		log.Printf("Comment %d deleted.", *commentDeleteID)
 	case detailsCmd.FullCommand():
-		details(*detailsID)
+		return details(ac, *detailsID)
 	case createDBCmd.FullCommand():
-		createDB()
+		// (MySQL commits after each CREATE TABLE regardless, but the others don't)
+		return ac.inTransaction(createDB)
+	case upgradeDBCmd.FullCommand():
+		return ac.inTransaction(upgradeDB)
 	case destroyDBCmd.FullCommand():
-		destroyDB()
+		return ac.inTransaction(destroyDB)
+	case fsckCmd.FullCommand():
+		if !*fsckFix {
+			return fsck(ac, false, *fsckTrust)
+		}
+		return ac.inTransaction(func(tx *appContext) error { return fsck(tx, true, *fsckTrust) })
 	case makeNoodlesCmd.FullCommand():
-		makeNoodles()
+		return ac.inTransaction(makeNoodles)
 	case jsonDumpCmd.FullCommand():
-		dumpAllAsJson()
+		return dumpAllAsJson(ac, *jsonDumpNoFiles, *jsonDumpSince, *jsonDumpIDs)
+	case backupCreateSubcmd.FullCommand():
+		if *backupFile == "" {
+			today := ac.today()
+			*backupFile = "exceptions-backup." + stringFromDate(&today) + ".tar.gz"
+		}
+		return backup(ac, *backupFile)
+	case restoreCmd.FullCommand():
+		return restore(ac, *restoreFile)
 	case jsonImportCmd.FullCommand():
-		importAllAsJson()
+		if *jsonImportDryRun {
+			return importAllAsJson(ac, os.Stdin, *jsonImportMode, true)
+		}
+		return ac.inTransaction(func(tx *appContext) error {
+			return importAllAsJson(tx, os.Stdin, *jsonImportMode, false)
+		})
 	case renewCmd.FullCommand():
-		notYetImplemented()
-	case examplesCmd.FullCommand():
-		printExamples()
+		return notYetImplemented()
 	default:
-		kingpin.FatalUsage("Barely-handled error in command-line parsing")
+		return usageErrorf("barely-handled error in command-line parsing")
 	}
+	return nil
 }
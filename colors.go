@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Whether output should be coloured: set in main, from colorWanted, before
+// anything's printed.
+var useColor bool
+
+// --color=always and --color=never do what they say. Otherwise, output is
+// coloured if it's going to a terminal, unless NO_COLOR is set to anything
+// (see https://no-color.org/).
+func colorWanted(mode string) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return terminal.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// Wraps text in one of the colours in colorMap, if output is being coloured.
+func colorize(text string, color string) string {
+	if !useColor || text == "" || color == "" {
+		return text
+	}
+	return colorMap[color] + text + colorMap["RESET"]
+}
+
+// Statuses that need someone to do something stand out: rejected and
+// removed exceptions are finished with, so they're left plain.
+var statusColors = map[string]string{
+	"undecided":   "YELLOW",
+	"approved":    "CYAN",
+	"implemented": "GREEN",
+}
+
+// An implemented exception that's past its end date still needs removing,
+// which is more urgent than anything else.
+func (ac *appContext) isOverdue(exception *Exception) bool {
+	return exception.GetStatus() == "implemented" &&
+		exception.EndDate != nil &&
+		exception.EndDate.Before(ac.today())
+}
+
+func (ac *appContext) coloredStatus(exception *Exception) string {
+	if ac.isOverdue(exception) {
+		return colorize(exception.GetStatus(), "RED")
+	}
+	return colorize(exception.GetStatus(), statusColors[exception.GetStatus()])
+}
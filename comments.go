@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/olekukonko/tablewriter"
+)
+
+// Comments keep their IDs when they're edited, so replies and anything
+// else that mentions them still make sense. The text they had before is
+// kept as a separate Comment whose ReplacedByID points at the edited one,
+// which shows up in `comment list --history` but nowhere else.
+
+func getComment(db *gorm.DB, commentID uint) (*Comment, error) {
+	comment := &Comment{}
+	err := db.First(comment, commentID).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, notFoundErrorf("no comment with ID %d", commentID)
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	if comment.ReplacedByID != nil {
+		return nil, validationErrorf("comment %d is an old version of comment %d: use that one instead", comment.ID, *comment.ReplacedByID)
+	}
+	return comment, nil
+}
+
+// Includes the old versions of edited comments: see threadComments.
+func getCommentsForException(db *gorm.DB, id uint) ([]Comment, error) {
+	_, err := GetException(db, id)
+	if err != nil {
+		return nil, err
+	}
+	var comments []Comment
+	err = db.Where("exception_id = ?", id).Order("id").Find(&comments).Error
+	return comments, dbError(err)
+}
+
+func replyToComment(ac *appContext, parentID uint, text string) (uint, error) {
+	parent, err := getComment(ac.db, parentID)
+	if err != nil {
+		return 0, err
+	}
+	username, err := currentUsername()
+	if err != nil {
+		return 0, err
+	}
+	reply := &Comment{ExceptionID: parent.ExceptionID, ParentID: &parent.ID, CommentText: text, CommentBy: username}
+	err = ac.db.Save(reply).Error
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return reply.ID, nil
+}
+
+func editComment(ac *appContext, commentID uint, newText string) error {
+	comment, err := getComment(ac.db, commentID)
+	if err != nil {
+		return err
+	}
+	if newText == comment.CommentText {
+		return validationErrorf("comment %d already says exactly that", comment.ID)
+	}
+
+	// The old version is dated from when it was written (or last edited)
+	oldVersion := &Comment{
+		ExceptionID:  comment.ExceptionID,
+		ParentID:     comment.ParentID,
+		CommentBy:    comment.CommentBy,
+		CommentText:  comment.CommentText,
+		ReplacedByID: &comment.ID,
+	}
+	oldVersion.CreatedAt = comment.UpdatedAt
+	oldVersion.UpdatedAt = comment.UpdatedAt
+	err = ac.db.Create(oldVersion).Error
+	if err != nil {
+		return dbError(err)
+	}
+	err = ac.db.Model(comment).Update("comment_text", newText).Error
+	if err != nil {
+		return dbError(err)
+	}
+	return recordAudit(ac.db, comment.ExceptionID, "edit comment", fmt.Sprintf("edited comment %d, keeping the old version as comment %d", comment.ID, oldVersion.ID))
+}
+
+// Soft-deletes a comment, so it's still in the database, but not shown
+// anywhere or dumped. Any replies to it are left alone.
+func deleteComment(ac *appContext, commentID uint) error {
+	comment, err := getComment(ac.db, commentID)
+	if err != nil {
+		return err
+	}
+	err = ac.db.Delete(comment).Error
+	if err != nil {
+		return dbError(err)
+	}
+	return recordAudit(ac.db, comment.ExceptionID, "delete comment", fmt.Sprintf("deleted comment %d, written by %s", comment.ID, comment.CommentBy))
+}
+
+type threadedComment struct {
+	*Comment
+	depth int
+	// Set if this is a reply to a comment that's since been deleted
+	orphaned bool
+	// Set if there's an old version of this comment
+	edited bool
+}
+
+// Puts replies straight after what they're replying to, in the order they
+// were written. Replies to comments that aren't there any more go where
+// they'd have gone anyway, as if they weren't replies. Old versions are
+// left out unless withHistory is set, in which case they go after the
+// comment they're old versions of.
+func threadComments(comments []Comment, withHistory bool) []threadedComment {
+	byID := make(map[uint]bool, len(comments))
+	edited := make(map[uint]bool)
+	for _, v := range comments {
+		byID[v.ID] = true
+		if v.ReplacedByID != nil {
+			edited[*v.ReplacedByID] = true
+		}
+	}
+	replies := make(map[uint][]*Comment)
+	var topLevel []*Comment
+	oldVersions := make(map[uint][]*Comment)
+	for i := range comments {
+		comment := &comments[i]
+		if comment.ReplacedByID != nil {
+			oldVersions[*comment.ReplacedByID] = append(oldVersions[*comment.ReplacedByID], comment)
+			continue
+		}
+		if comment.ParentID != nil && byID[*comment.ParentID] {
+			replies[*comment.ParentID] = append(replies[*comment.ParentID], comment)
+		} else {
+			topLevel = append(topLevel, comment)
+		}
+	}
+
+	var threaded []threadedComment
+	var add func(comment *Comment, depth int)
+	add = func(comment *Comment, depth int) {
+		threaded = append(threaded, threadedComment{
+			Comment:  comment,
+			depth:    depth,
+			orphaned: comment.ParentID != nil && !byID[*comment.ParentID],
+			edited:   edited[comment.ID],
+		})
+		if withHistory {
+			for _, old := range oldVersions[comment.ID] {
+				threaded = append(threaded, threadedComment{Comment: old, depth: depth})
+			}
+		}
+		for _, reply := range replies[comment.ID] {
+			add(reply, depth+1)
+		}
+	}
+	for _, comment := range topLevel {
+		add(comment, 0)
+	}
+	return threaded
+}
+
+// For the editor, to say what's being commented on: see getTextFromEditor.
+func commentEditorSummary(exception *Exception) []string {
+	return []string{
+		fmt.Sprintf("Exception %d: %s %s for %s on %s", exception.ID, exception.GetStatus(), exception.ExceptionType, exception.Username, exception.Service),
+		"Detail: " + exception.ExceptionDetail,
+		fmt.Sprintf("From %s to %s", stringFromDate(exception.StartDate), stringFromDate(exception.EndDate)),
+	}
+}
+
+// As commentEditorSummary, plus the comment being replied to.
+func replyEditorSummary(db *gorm.DB, parent *Comment) ([]string, error) {
+	exception, err := GetException(db, parent.ExceptionID)
+	if err != nil {
+		return nil, err
+	}
+	summary := append(commentEditorSummary(exception), "", fmt.Sprintf("Replying to comment %d, by %s:", parent.ID, parent.CommentBy))
+	for _, line := range strings.Split(strings.TrimSpace(parent.CommentText), "\n") {
+		summary = append(summary, "> "+line)
+	}
+	return summary, nil
+}
+
+// For a comment on an exception that hasn't been submitted yet.
+func (fields *submissionFields) commentEditorSummary() []string {
+	ends := fields.Ends
+	if ends == "" {
+		ends = "a year from today"
+	}
+	return []string{
+		fmt.Sprintf("New exception: %s for %s on %s", fields.Type, fields.Username, fields.Service),
+		"Detail: " + fields.Detail,
+		fmt.Sprintf("From %s to %s", fields.Starts, ends),
+	}
+}
+
+// e.g. "#5 by ccspapp [2026-10-19 14:02, edited]", for details and the like
+func (ac *appContext) commentHeading(comment *threadedComment) string {
+	heading := fmt.Sprintf("#%d by %s [%s", comment.ID, comment.CommentBy, ac.localTime(comment.CreatedAt))
+	if comment.edited {
+		heading += ", edited"
+	}
+	heading += "]"
+	if comment.orphaned {
+		heading += fmt.Sprintf(", replying to deleted #%d", *comment.ParentID)
+	}
+	return strings.Repeat("  ", comment.depth) + heading
+}
+
+func listCommentsForException(ac *appContext, id uint, withHistory bool) error {
+	comments, err := getCommentsForException(ac.db, id)
+	if err != nil {
+		return err
+	}
+
+	threaded := threadComments(comments, withHistory)
+	if len(threaded) == 0 {
+		fmt.Printf("No comments on exception %d.\n", id)
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	header := []string{"ID", "Reply To", "By", "Written", "Edited", "Comment"}
+	if withHistory {
+		header = append(header, "Replaced By")
+	}
+	table.SetHeader(header)
+	table.SetBorder(false)
+	table.SetAutoWrapText(false)
+
+	for _, comment := range threaded {
+		replyTo, edited := "", ""
+		if comment.ParentID != nil {
+			replyTo = fmt.Sprint(*comment.ParentID)
+		}
+		if comment.edited {
+			edited = ac.localTime(comment.UpdatedAt)
+		}
+		row := []string{fmt.Sprint(comment.ID),
+			replyTo,
+			comment.CommentBy,
+			ac.localTime(comment.CreatedAt),
+			edited,
+			strings.Repeat("  ", comment.depth) + firstLine(comment.CommentText),
+		}
+		if withHistory {
+			replacedBy := ""
+			if comment.ReplacedByID != nil {
+				replacedBy = fmt.Sprint(*comment.ReplacedByID)
+			}
+			row = append(row, replacedBy)
+		}
+		table.Append(row)
+	}
+	table.Render()
+	return nil
+}
+
+// Long comments are for details to show in full: lists just get the start.
+func firstLine(text string) string {
+	line := strings.TrimSpace(text)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = strings.TrimSpace(line[:i]) + " ..."
+	}
+	const maxLength = 60
+	if len([]rune(line)) > maxLength {
+		line = string([]rune(line)[:maxLength-4]) + " ..."
+	}
+	return line
+}
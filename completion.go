@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Shell completion works the way kingpin's own does: the scripts below
+// run `exceptions --completion-bash WORDS...`, and kingpin prints what
+// could come next, from the commands and flags in cli.go and the hint
+// functions here. kingpin only has scripts for bash and (through bash's)
+// zsh, and can't show descriptions, so these replace them.
+//
+// The hints for IDs and the like come from the database, using the
+// config file from the command line being completed. Anything that goes
+// wrong just means no suggestions: there's nowhere to show an error.
+
+// The hints are added here, rather than where the arguments are declared
+// in cli.go, because referring to these functions there would make Go
+// initialise those arguments later, and so put them in the wrong order.
+func init() {
+	for _, cmd := range []*kingpin.CmdClause{undecideCmd, approveCmd, rejectCmd, removeCmd, implementCmd, deleteCmd, detailsCmd,
+		attachSubcmd, downloadForExSubcmd, filelistSubcmd, verifySubcmd, commentAddSubcmd, commentListSubcmd} {
+		cmd.GetArg("id").HintAction(exceptionIDHints)
+	}
+	downloadSubcmd.GetArg("id").HintAction(fileIDHints)
+	for _, cmd := range []*kingpin.CmdClause{formRemoveSubcmd, formReplaceSubcmd} {
+		cmd.GetArg("file-id").HintAction(fileIDHints)
+	}
+	for _, cmd := range []*kingpin.CmdClause{commentReplySubcmd, commentEditSubcmd, commentDeleteSubcmd} {
+		cmd.GetArg("comment-id").HintAction(commentIDHints)
+	}
+	submitCmd.GetFlag("username").HintAction(exceptionColumnHints("username"))
+	listCmd.GetFlag("service").HintAction(exceptionColumnHints("service"))
+}
+
+func completionScript(shell string) string {
+	switch shell {
+	case "zsh":
+		return zshCompletionScript
+	case "fish":
+		return fishCompletionScript
+	}
+	return bashCompletionScript
+}
+
+// kingpin takes a partly-typed argument as the whole argument, so these
+// only pass it the words before the current one, and leave the shell to
+// match what's been typed so far, except for flags, which kingpin only
+// lists if it can see the start of one.
+
+const bashCompletionScript = `# bash completion for exceptions: source this, e.g. from ~/.bashrc with
+#   source <(exceptions completion bash)
+_exceptions_completion() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" words
+    if [[ "$cur" == -* ]]; then
+        words=("${COMP_WORDS[@]:1:COMP_CWORD}")
+    else
+        words=("${COMP_WORDS[@]:1:COMP_CWORD-1}")
+    fi
+    local IFS=$'\n'
+    COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]}" --completion-bash "${words[@]}" 2>/dev/null)" -- "$cur"))
+}
+complete -o default -F _exceptions_completion exceptions
+`
+
+const zshCompletionScript = `#compdef exceptions
+# zsh completion for exceptions: put this in a file called _exceptions
+# somewhere in $fpath, or source it, e.g. from ~/.zshrc with
+#   source <(exceptions completion zsh)
+_exceptions() {
+    local line
+    local -a before completions described
+    if [[ "${words[CURRENT]}" == -* ]]; then
+        before=("${(@)words[2,CURRENT]}")
+    else
+        before=("${(@)words[2,CURRENT-1]}")
+    fi
+    completions=("${(@f)$("${words[1]}" --completion-descriptions --completion-bash "${(@)before}" 2>/dev/null)}")
+    for line in "${(@)completions}"; do
+        [[ -n "$line" ]] || continue
+        if [[ "$line" == *$'\t'* ]]; then
+            described+=("${${line%%$'\t'*}//:/\\:}:${line#*$'\t'}")
+        else
+            described+=("${line//:/\\:}")
+        fi
+    done
+    if (( ${#described} )); then
+        _describe 'exceptions' described
+    else
+        _files
+    fi
+}
+if [[ "${funcstack[1]}" == "_exceptions" ]]; then
+    _exceptions "$@"
+else
+    compdef _exceptions exceptions
+fi
+`
+
+const fishCompletionScript = `# fish completion for exceptions: put this in
+# ~/.config/fish/completions/exceptions.fish, or source it with
+#   exceptions completion fish | source
+function __exceptions_complete
+    set -l words (commandline -opc)
+    set -l current (commandline -ct)
+    set -l command $words[1]
+    set -e words[1]
+    if string match -q -- '-*' $current
+        set -a words $current
+    end
+    set -l completions ($command --completion-descriptions --completion-bash $words 2>/dev/null)
+    if test (count $completions) -gt 0
+        printf '%s\n' $completions
+    else
+        __fish_complete_path $current
+    end
+end
+complete -c exceptions -f -a '(__exceptions_complete)'
+`
+
+// Opens the database for a hint function, without logging anything, or
+// returns nil if it can't.
+func completionDB() *gorm.DB {
+	ac, err := newAppContext(*configFile, false)
+	if err != nil {
+		return nil
+	}
+	return ac.db.LogMode(false)
+}
+
+// Turns value and description into a suggestion, leaving the description
+// off if the shell can't show it.
+func completion(value interface{}, description string) string {
+	if !*completionDescriptions || description == "" {
+		return fmt.Sprint(value)
+	}
+	return fmt.Sprintf("%v\t%s", value, strings.Join(strings.Fields(description), " "))
+}
+
+func exceptionIDHints() []string {
+	db := completionDB()
+	if db == nil {
+		return nil
+	}
+	defer db.Close()
+
+	var exceptions []Exception
+	if db.Order("id").Find(&exceptions).Error != nil {
+		return nil
+	}
+	hints := make([]string, 0, len(exceptions))
+	for _, ex := range exceptions {
+		hints = append(hints, completion(ex.ID, fmt.Sprintf("%s: %s %s on %s, %s", ex.Username, ex.ExceptionDetail, ex.ExceptionType, ex.Service, ex.GetStatus())))
+	}
+	return hints
+}
+
+// Only current versions, since old ones can't be replied to, edited, etc.
+func commentIDHints() []string {
+	db := completionDB()
+	if db == nil {
+		return nil
+	}
+	defer db.Close()
+
+	var comments []Comment
+	if db.Where("replaced_by_id IS NULL").Order("id").Find(&comments).Error != nil {
+		return nil
+	}
+	hints := make([]string, 0, len(comments))
+	for _, v := range comments {
+		hints = append(hints, completion(v.ID, fmt.Sprintf("on exception %d, by %s: %s", v.ExceptionID, v.CommentBy, firstLine(v.CommentText))))
+	}
+	return hints
+}
+
+func fileIDHints() []string {
+	db := completionDB()
+	if db == nil {
+		return nil
+	}
+	defer db.Close()
+
+	// Leaving out the contents, which could be big
+	var files []FormFile
+	if db.Select("id, exception_id, file_name").Order("id").Find(&files).Error != nil {
+		return nil
+	}
+	hints := make([]string, 0, len(files))
+	for _, v := range files {
+		hints = append(hints, completion(v.ID, fmt.Sprintf("%s, on exception %d", v.FileName, v.ExceptionID)))
+	}
+	return hints
+}
+
+// The different values of one of the exceptions table's columns, e.g.
+// the usernames that have exceptions already.
+func exceptionColumnHints(column string) func() []string {
+	return func() []string {
+		db := completionDB()
+		if db == nil {
+			return nil
+		}
+		defer db.Close()
+
+		var values []string
+		if db.Model(&Exception{}).Order(column).Pluck("DISTINCT "+column, &values).Error != nil {
+			return nil
+		}
+		return values
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// How a FormFile's contents are stored, in its Compression field. Files are
+// only kept compressed if that saves a worthwhile amount of space, so even
+// with compression turned on, plenty of files end up stored as they are.
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// Compressed contents are only kept if they're at most this fraction of
+// the size of the original.
+const worthwhileCompression = 0.9
+
+// Formats that are compressed already, which it isn't worth trying to
+// compress again. Anything starting with one of these is skipped.
+var incompressibleTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"audio/",
+	"video/",
+	"application/zip", // Includes .docx, .xlsx, etc, if they weren't recognised by extension
+	"application/x-gzip",
+	"application/x-rar-compressed",
+	"application/x-7z-compressed",
+	"application/vnd.openxmlformats-officedocument.",
+	"application/vnd.oasis.opendocument.",
+}
+
+func isCompressibleType(mimeType string) bool {
+	for _, v := range incompressibleTypes {
+		if strings.HasPrefix(mimeType, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns what should be stored for contents, and the Compression that
+// goes with it.
+func compressForStorage(contents []byte, mimeType string, algorithm string) ([]byte, string, error) {
+	if algorithm == compressionNone || !isCompressibleType(mimeType) {
+		return contents, compressionNone, nil
+	}
+
+	compressed, err := compress(contents, algorithm)
+	if err != nil {
+		return nil, "", err
+	}
+	if float64(len(compressed)) > worthwhileCompression*float64(len(contents)) {
+		return contents, compressionNone, nil
+	}
+	return compressed, algorithm, nil
+}
+
+func compress(contents []byte, algorithm string) ([]byte, error) {
+	switch algorithm {
+	case compressionNone:
+		return contents, nil
+	case compressionGzip:
+		var buffer bytes.Buffer
+		writer, err := gzip.NewWriterLevel(&buffer, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		_, err = writer.Write(contents)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not compress file: %s", err)
+		}
+		return buffer.Bytes(), nil
+	case compressionZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		if err != nil {
+			return nil, err
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(contents, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
+
+func decompress(stored []byte, algorithm string) ([]byte, error) {
+	switch algorithm {
+	case compressionNone:
+		return stored, nil
+	case compressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(stored))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
+	case compressionZstd:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(stored, nil)
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
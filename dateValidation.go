@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Everything wrong with an exception's dates, as far as policy goes: see
+// submitWithAllParts, which refuses to submit an exception with any of
+// these unless it's forced. fsck's checkDates is the after-the-fact
+// equivalent for what's already in the database.
+func dateProblems(submitDate, startDate, endDate time.Time, exceptionType string, maxDurations map[string]dateSpan, today time.Time) []string {
+	var problems []string
+
+	if submitDate.After(today) {
+		problems = append(problems, fmt.Sprintf("the submitted date (%s) is in the future", stringFromDate(&submitDate)))
+	}
+	if startDate.After(endDate) {
+		problems = append(problems, fmt.Sprintf("it starts (%s) after it ends (%s)", stringFromDate(&startDate), stringFromDate(&endDate)))
+	} else if maxDuration, ok := maxDurations[exceptionType]; ok {
+		latestEnd := maxDuration.addTo(startDate)
+		if endDate.After(latestEnd) {
+			problems = append(problems, fmt.Sprintf("%s exceptions can last at most %s, so one starting on %s should end by %s, not %s",
+				exceptionType, maxDuration, stringFromDate(&startDate), stringFromDate(&latestEnd), stringFromDate(&endDate)))
+		}
+	}
+	return problems
+}
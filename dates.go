@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Everything that turns what people type for a date into a time.Time is
+// in here, so that submit, the wizard and forms all accept the same things:
+//
+//   - 2026-01-31, and the ways people write dates in forms: 31/01/2026,
+//     31 January 2026, 31st Jan 2026, January 31, 2026, etc
+//   - today, tomorrow and yesterday
+//   - +90d, +2w, +6m, +1y (or +90 days, +6 months, etc), and the same with -
+//   - next-monday through next-sunday: the first one after today
+//   - start-of-term, end-of-term and start-of-next-term, from the terms in
+//     the academic_calendar section of the config file
+//   - the names of any dates in academic_calendar, e.g. graduation
+//
+// Dates are calendar dates, with no time or zone of their own: in Go
+// they're midnight UTC on the day (see calendarDate), which is what the
+// database has always had in it, and in the database they're DATE columns
+// where the database has them. Working out what today is, and when an
+// exception actually starts and ends, is done in the time zone from the
+// config file (see appContext.today and expiresAt).
+
+const dateLayout = "2006-01-02"
+
+// The same day as t, in t's own zone, as midnight UTC.
+func calendarDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Today's date in the configured time zone.
+func (ac *appContext) today() time.Time {
+	return calendarDate(ac.now.In(ac.config.location))
+}
+
+// For showing when something happened, like a comment being written.
+func (ac *appContext) localTime(t time.Time) string {
+	return t.In(ac.config.location).Format("2006-01-02 15:04")
+}
+
+// An exception starts at the beginning of its start date and lasts until
+// the end of its end date, in the given zone. These use time.Date rather
+// than adding 24 hours, because not every day is 24 hours long.
+func startsAt(startDate time.Time, location *time.Location) time.Time {
+	return time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, location)
+}
+
+func expiresAt(endDate time.Time, location *time.Location) time.Time {
+	return time.Date(endDate.Year(), endDate.Month(), endDate.Day()+1, 0, 0, 0, 0, location)
+}
+
+// How many days from one date to another: both are midnight UTC, which has
+// no clock changes, so this is exact.
+func daysBetween(from time.Time, to time.Time) int {
+	return int(to.Sub(from).Hours() / 24)
+}
+
+// The ways people write dates in forms and emails, tried in order.
+// Slashes are read the UK way round.
+var writtenDateLayouts = []string{dateLayout, "02/01/2006", "2/1/2006", "2 January 2006", "2 Jan 2006", "January 2 2006", "Jan 2 2006"}
+
+var ordinalSuffixRegexp = regexp.MustCompile(`(\d)(st|nd|rd|th)\b`)
+
+// A length of time in calendar terms, e.g. "3 months", for relative dates
+// and the policy limits in max_durations. Months and years are added with
+// AddDate, so "3 months" from 2026-01-31 is 2026-05-01.
+type dateSpan struct {
+	years, months, days int
+	text                string
+}
+
+func (span dateSpan) addTo(date time.Time) time.Time {
+	return date.AddDate(span.years, span.months, span.days)
+}
+
+func (span dateSpan) subtractFrom(date time.Time) time.Time {
+	return date.AddDate(-span.years, -span.months, -span.days)
+}
+
+func (span dateSpan) String() string { return span.text }
+
+var dateSpanRegexp = regexp.MustCompile(`^(\d+)\s*([a-z]+)$`)
+
+// Spans like "90 days", "2 weeks", "3 months" or "1 year", or shortened
+// to "90d", "2w", "3m" or "1y".
+func parseDateSpan(text string) (dateSpan, error) {
+	match := dateSpanRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(text)))
+	if match == nil {
+		return dateSpan{}, fmt.Errorf("%q is not a length of time (should be something like \"3 months\" or \"90d\")", text)
+	}
+	number, err := strconv.Atoi(match[1])
+	if err != nil || number <= 0 {
+		return dateSpan{}, fmt.Errorf("%q is not a length of time (should be something like \"3 months\" or \"90d\")", text)
+	}
+
+	span := dateSpan{text: strings.TrimSpace(text)}
+	switch strings.TrimSuffix(match[2], "s") {
+	case "d", "day":
+		span.days = number
+	case "w", "week":
+		span.days = 7 * number
+	case "m", "month":
+		span.months = number
+	case "y", "year":
+		span.years = number
+	default:
+		return dateSpan{}, fmt.Errorf("%q is not a length of time (the units can be days, weeks, months or years)", text)
+	}
+	return span, nil
+}
+
+// The academic_calendar section of the config file, e.g.
+//
+//	"academic_calendar": {
+//	    "terms": [{"name": "autumn", "starts": "2026-09-28", "ends": "2026-12-11"}],
+//	    "dates": {"graduation": "2027-07-05"}
+//	}
+type academicCalendar struct {
+	Terms []academicTerm    `json:"terms"`
+	Dates map[string]string `json:"dates"`
+
+	// Parsed from the above by check
+	dates map[string]time.Time
+}
+
+type academicTerm struct {
+	Name   string `json:"name"`
+	Starts string `json:"starts"`
+	Ends   string `json:"ends"`
+
+	starts, ends time.Time
+}
+
+// Parses all the dates, and sorts the terms into order.
+func (calendar *academicCalendar) check() error {
+	var err error
+	for i := range calendar.Terms {
+		term := &calendar.Terms[i]
+		term.starts, err = time.Parse(dateLayout, term.Starts)
+		if err != nil {
+			return fmt.Errorf("term %q has a start date of %q, which isn't YYYY-MM-DD", term.Name, term.Starts)
+		}
+		term.ends, err = time.Parse(dateLayout, term.Ends)
+		if err != nil {
+			return fmt.Errorf("term %q has an end date of %q, which isn't YYYY-MM-DD", term.Name, term.Ends)
+		}
+		if term.starts.After(term.ends) {
+			return fmt.Errorf("term %q starts after it ends", term.Name)
+		}
+	}
+	sort.Slice(calendar.Terms, func(i, j int) bool { return calendar.Terms[i].starts.Before(calendar.Terms[j].starts) })
+
+	calendar.dates = make(map[string]time.Time, len(calendar.Dates))
+	for name, text := range calendar.Dates {
+		calendar.dates[strings.ToLower(name)], err = time.Parse(dateLayout, text)
+		if err != nil {
+			return fmt.Errorf("%q is %q, which isn't YYYY-MM-DD", name, text)
+		}
+	}
+	return nil
+}
+
+// The term today is in, or if it's between terms, the next one.
+func (calendar *academicCalendar) currentTerm(today time.Time) (*academicTerm, error) {
+	for i := range calendar.Terms {
+		if !calendar.Terms[i].ends.Before(today) {
+			return &calendar.Terms[i], nil
+		}
+	}
+	return nil, fmt.Errorf("the academic_calendar in the config file has no terms after %s", stringFromDate(&today))
+}
+
+func (calendar *academicCalendar) nextTerm(today time.Time) (*academicTerm, error) {
+	for i := range calendar.Terms {
+		if calendar.Terms[i].starts.After(today) {
+			return &calendar.Terms[i], nil
+		}
+	}
+	return nil, fmt.Errorf("the academic_calendar in the config file has no terms starting after %s", stringFromDate(&today))
+}
+
+// Parses dates as of a particular day, with a particular calendar: use
+// appContext.dateParser to get one for today.
+type dateParser struct {
+	today    time.Time
+	calendar *academicCalendar // May be nil, if there isn't one in the config file
+}
+
+func (ac *appContext) dateParser() dateParser {
+	return dateParser{today: ac.today(), calendar: ac.config.AcademicCalendar}
+}
+
+func (p dateParser) parse(text string) (time.Time, error) {
+	return p.parseRelativeTo(text, p.today)
+}
+
+// As parse, except that +6m and the like count from base rather than today.
+func (p dateParser) parseRelativeTo(text string, base time.Time) (time.Time, error) {
+	cleaned := strings.ToLower(strings.TrimSpace(text))
+
+	if strings.HasPrefix(cleaned, "+") || strings.HasPrefix(cleaned, "-") {
+		span, err := parseDateSpan(cleaned[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if cleaned[0] == '-' {
+			return span.subtractFrom(base), nil
+		}
+		return span.addTo(base), nil
+	}
+
+	switch cleaned {
+	case "today":
+		return p.today, nil
+	case "tomorrow":
+		return p.today.AddDate(0, 0, 1), nil
+	case "yesterday":
+		return p.today.AddDate(0, 0, -1), nil
+	case "start-of-term", "end-of-term", "start-of-next-term":
+		if p.calendar == nil || len(p.calendar.Terms) == 0 {
+			return time.Time{}, fmt.Errorf("%q needs terms in the academic_calendar section of the config file", text)
+		}
+		var term *academicTerm
+		var err error
+		if cleaned == "start-of-next-term" {
+			term, err = p.calendar.nextTerm(p.today)
+		} else {
+			term, err = p.calendar.currentTerm(p.today)
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		if cleaned == "end-of-term" {
+			return term.ends, nil
+		}
+		return term.starts, nil
+	}
+
+	if strings.HasPrefix(cleaned, "next-") {
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if cleaned == "next-"+strings.ToLower(day.String()) {
+				daysAhead := (int(day)-int(p.today.Weekday())+6)%7 + 1
+				return p.today.AddDate(0, 0, daysAhead), nil
+			}
+		}
+	}
+
+	if p.calendar != nil {
+		if date, ok := p.calendar.dates[cleaned]; ok {
+			return date, nil
+		}
+	}
+
+	written := ordinalSuffixRegexp.ReplaceAllString(strings.Replace(text, ",", " ", -1), "$1")
+	written = strings.Join(strings.Fields(written), " ")
+	for _, layout := range writtenDateLayouts {
+		date, err := time.Parse(layout, written)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date (should be YYYY-MM-DD, today, +90d, +6m, next-monday, end-of-term, etc)", text)
+}
+
+// Works out all three of an exception's dates. A relative end date, like
+// +6m, counts from the start date rather than today, since that's almost
+// always what's meant, and no end date at all means a year from today.
+func (p dateParser) exceptionDates(submitted, starts, ends string) (submitDate, startDate, endDate time.Time, err error) {
+	submitDate, err = p.parse(submitted)
+	if err != nil {
+		return submitDate, startDate, endDate, validationErrorf("could not parse submit date: %s", err)
+	}
+	startDate, err = p.parse(starts)
+	if err != nil {
+		return submitDate, startDate, endDate, validationErrorf("could not parse start date: %s", err)
+	}
+	endDate, err = p.parseEndDate(ends, startDate)
+	if err != nil {
+		return submitDate, startDate, endDate, validationErrorf("could not parse end date: %s", err)
+	}
+	return submitDate, startDate, endDate, nil
+}
+
+func (p dateParser) parseEndDate(text string, startDate time.Time) (time.Time, error) {
+	if strings.TrimSpace(text) == "" {
+		return p.today.AddDate(1, 0, 0), nil
+	}
+	return p.parseRelativeTo(text, startDate)
+}
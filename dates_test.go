@@ -0,0 +1,229 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testNow is a Monday
+func TestParseDates(t *testing.T) {
+	calendar := &academicCalendar{
+		Terms: []academicTerm{
+			{Name: "summer", Starts: "2026-04-20", Ends: "2026-06-26"},
+			{Name: "autumn", Starts: "2026-09-28", Ends: "2026-12-11"},
+		},
+		Dates: map[string]string{"Graduation": "2026-07-06"},
+	}
+	err := calendar.check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser := dateParser{today: calendarDate(testNow), calendar: calendar}
+
+	for _, v := range []struct {
+		text string
+		want string
+	}{
+		{"2026-03-01", "2026-03-01"},
+		{"01/03/2026", "2026-03-01"},
+		{"1/3/2026", "2026-03-01"},
+		{"1 March 2026", "2026-03-01"},
+		{"1st Mar 2026", "2026-03-01"},
+		{"March 1, 2026", "2026-03-01"},
+		{"Mar 1st 2026", "2026-03-01"},
+		{"today", "2026-06-15"},
+		{" Today ", "2026-06-15"},
+		{"tomorrow", "2026-06-16"},
+		{"yesterday", "2026-06-14"},
+		{"+90d", "2026-09-13"},
+		{"+90 days", "2026-09-13"},
+		{"+2w", "2026-06-29"},
+		{"+6m", "2026-12-15"},
+		{"+6 months", "2026-12-15"},
+		{"+1y", "2027-06-15"},
+		{"-1w", "2026-06-08"},
+		{"next-monday", "2026-06-22"},
+		{"next-tuesday", "2026-06-16"},
+		{"next-sunday", "2026-06-21"},
+		{"start-of-term", "2026-04-20"},
+		{"end-of-term", "2026-06-26"},
+		{"start-of-next-term", "2026-09-28"},
+		{"graduation", "2026-07-06"},
+	} {
+		got, err := parser.parse(v.text)
+		if err != nil {
+			t.Errorf("parse(%q): %s", v.text, err)
+			continue
+		}
+		if got.Format(dateLayout) != v.want {
+			t.Errorf("parse(%q): got %s, want %s", v.text, got.Format(dateLayout), v.want)
+		}
+	}
+
+	for _, text := range []string{"", "sometime", "+6", "+0d", "+6 fortnights", "next-week", "31/02/2026", "2026-13-01"} {
+		_, err := parser.parse(text)
+		if err == nil {
+			t.Errorf("parse(%q) should have failed", text)
+		}
+	}
+}
+
+func TestParseDatesWithoutCalendar(t *testing.T) {
+	parser := dateParser{today: calendarDate(testNow)}
+	for _, text := range []string{"end-of-term", "graduation"} {
+		_, err := parser.parse(text)
+		if err == nil {
+			t.Errorf("parse(%q) with no academic_calendar should have failed", text)
+		}
+	}
+}
+
+// Months are added with AddDate, so they can overflow into the next one.
+func TestParseEndDate(t *testing.T) {
+	parser := dateParser{today: calendarDate(testNow)}
+	startDate := time.Date(2026, time.January, 31, 0, 0, 0, 0, time.UTC)
+	for _, v := range []struct {
+		text string
+		want string
+	}{
+		{"+3m", "2026-05-01"},
+		{"+1w", "2026-02-07"},
+		{"2026-03-01", "2026-03-01"},
+		{"", "2027-06-15"},
+	} {
+		got, err := parser.parseEndDate(v.text, startDate)
+		if err != nil {
+			t.Errorf("parseEndDate(%q): %s", v.text, err)
+			continue
+		}
+		if got.Format(dateLayout) != v.want {
+			t.Errorf("parseEndDate(%q): got %s, want %s", v.text, got.Format(dateLayout), v.want)
+		}
+	}
+}
+
+// In London, the clocks go forward at 01:00 UTC on 2026-03-29, and back at
+// 01:00 UTC on 2026-10-25.
+func loadLondon(t *testing.T) *time.Location {
+	t.Helper()
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("no time zone data: %s", err)
+	}
+	return london
+}
+
+func utc(text string) time.Time {
+	t, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func date(text string) time.Time {
+	t, err := time.Parse(dateLayout, text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestTodayAcrossClockChanges(t *testing.T) {
+	london := loadLondon(t)
+	for _, v := range []struct {
+		now  string
+		want string
+	}{
+		{"2026-03-29T00:30:00Z", "2026-03-29"}, // 00:30 GMT
+		{"2026-03-29T22:30:00Z", "2026-03-29"}, // 23:30 BST
+		{"2026-03-29T23:30:00Z", "2026-03-30"}, // 00:30 BST
+		{"2026-10-24T22:30:00Z", "2026-10-24"}, // 23:30 BST
+		{"2026-10-24T23:30:00Z", "2026-10-25"}, // 00:30 BST
+		{"2026-10-25T23:30:00Z", "2026-10-25"}, // 23:30 GMT
+		{"2026-10-26T00:30:00Z", "2026-10-26"}, // 00:30 GMT
+	} {
+		ac := &appContext{config: &DBConfig{location: london}, now: utc(v.now)}
+		got := ac.today()
+		if got != date(v.want) {
+			t.Errorf("today at %s: got %s, want %s", v.now, got, v.want)
+		}
+	}
+}
+
+// The days the clocks change on are 23 and 25 hours long.
+func TestStartsAtAndExpiresAtAcrossClockChanges(t *testing.T) {
+	london := loadLondon(t)
+	for _, v := range []struct {
+		day             string
+		starts, expires string
+		hours           float64
+	}{
+		{"2026-03-28", "2026-03-28T00:00:00Z", "2026-03-29T00:00:00Z", 24},
+		{"2026-03-29", "2026-03-29T00:00:00Z", "2026-03-29T23:00:00Z", 23},
+		{"2026-03-30", "2026-03-29T23:00:00Z", "2026-03-30T23:00:00Z", 24},
+		{"2026-10-25", "2026-10-24T23:00:00Z", "2026-10-26T00:00:00Z", 25},
+		{"2026-10-26", "2026-10-26T00:00:00Z", "2026-10-27T00:00:00Z", 24},
+	} {
+		starts, expires := startsAt(date(v.day), london), expiresAt(date(v.day), london)
+		if !starts.Equal(utc(v.starts)) {
+			t.Errorf("startsAt(%s): got %s, want %s", v.day, starts.UTC(), v.starts)
+		}
+		if !expires.Equal(utc(v.expires)) {
+			t.Errorf("expiresAt(%s): got %s, want %s", v.day, expires.UTC(), v.expires)
+		}
+		if expires.Sub(starts).Hours() != v.hours {
+			t.Errorf("%s: got %v long, want %v hours", v.day, expires.Sub(starts), v.hours)
+		}
+	}
+}
+
+func TestDurationRemainingAcrossClockChanges(t *testing.T) {
+	london := loadLondon(t)
+	for _, v := range []struct {
+		starts, ends string
+		now          string
+		want         string // The duration left, or the message if there isn't one
+	}{
+		{"2026-03-20", "2026-03-29", "2026-03-29T22:30:00Z", "30m0s"},
+		{"2026-03-20", "2026-03-29", "2026-03-29T23:00:00Z", "finished"},
+		{"2026-10-25", "2026-10-25", "2026-10-24T22:59:00Z", "not started yet"},
+		{"2026-10-25", "2026-10-25", "2026-10-24T23:00:00Z", "25h0m0s"},
+		{"2026-10-25", "2026-10-25", "2026-10-25T23:30:00Z", "30m0s"},
+		{"2026-10-25", "2026-10-25", "2026-10-26T00:00:00Z", "finished"},
+	} {
+		starts, ends := date(v.starts), date(v.ends)
+		exception := &Exception{StartDate: &starts, EndDate: &ends}
+		remaining, msg := exception.DurationRemaining(utc(v.now), london)
+		got := msg
+		if remaining != nil {
+			got = remaining.String()
+		}
+		if got != v.want {
+			t.Errorf("%s to %s at %s: got %q, want %q", v.starts, v.ends, v.now, got, v.want)
+		}
+	}
+}
+
+// What info shows is counted in calendar days in the configured zone.
+func TestTimeRemainingAcrossClockChanges(t *testing.T) {
+	london := loadLondon(t)
+	starts, ends := date("2026-10-01"), date("2026-10-25")
+	exception := &Exception{StartDate: &starts, EndDate: &ends}
+	for _, v := range []struct {
+		now  string
+		want string
+	}{
+		{"2026-10-23T23:30:00Z", "1 day"},          // 00:30 BST on the 24th
+		{"2026-10-24T22:30:00Z", "1 day"},          // 23:30 BST on the 24th
+		{"2026-10-24T23:30:00Z", "last day today"}, // 00:30 BST on the 25th
+		{"2026-10-25T23:30:00Z", "last day today"}, // 23:30 GMT on the 25th
+		{"2026-10-26T00:30:00Z", "finished"},
+	} {
+		ac := &appContext{config: &DBConfig{location: london}, now: utc(v.now)}
+		got := timeRemaining(ac, exception)
+		if got != v.want {
+			t.Errorf("time remaining at %s: got %q, want %q", v.now, got, v.want)
+		}
+	}
+}
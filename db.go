@@ -1,80 +1,58 @@
 package main
 
 import (
-	"fmt"
-	"log"
 	"time"
 
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/mysql"
-	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
-func destroyTables(db *gorm.DB) {
-	errors := db.DropTableIfExists(&Exception{}, &Comment{}, &FormFile{}, &StatusChange{}).GetErrors()
-
-	for _, err := range errors {
-		fmt.Printf("%s", err)
-	}
+// Everything that gets a table
+var allModels = []interface{}{&Exception{}, &Comment{}, &FormFile{}, &StatusChange{}, &AuditEntry{}}
+
+// The exceptions' dates, which used to be timestamps: see UpgradeOldTimes
+var exceptionDateColumns = []string{"submitted_date", "start_date", "end_date"}
+
+// Bump this whenever the models change in a way that shows up in a JSON
+// dump, so importjson can tell when it's been handed something it won't
+// understand. The history so far:
+//   - 1: the original tables (dumps were a bare JSON array with no header)
+//   - 2: added AuditEntry
+//   - 3: added FormFile.SHA256 and FormFile.Size
+//   - 4: added FormFile.Compression and FormFile.MIMEType
+//   - 5: added FormFile.Storage and FormFile.StorageKey
+//   - 6: added FormFile.Description and FormFile.ReplacedByID
+//   - 7: added Comment.ParentID and Comment.ReplacedByID
+const schemaVersion = 7
+
+func destroyTables(db *gorm.DB) error {
+	return dbError(db.DropTableIfExists(allModels...).Error)
 }
 
-func createTables(db *gorm.DB) {
-	errors := db.CreateTable(&Exception{}, &Comment{}, &FormFile{}, &StatusChange{}).GetErrors()
-
-	for _, err := range errors {
-		fmt.Printf("%s", err)
-	}
-}
-
-func getDB() *gorm.DB {
-	dbConfig := parseDBConfig(*configFile)
-
-	if dbConfig.DBType == "mysql" {
-		// If you don't pass parseTime=True here for MySQL DBs, time.Times won't work properly
-		dbConfig.DBConnectionString += "?charset=utf8&parseTime=True&loc=Local"
-	}
-
-	db, err := gorm.Open(dbConfig.DBType, dbConfig.DBConnectionString)
+func createTables(db *gorm.DB, dialect dbDialect) error {
+	err := db.CreateTable(allModels...).Error
 	if err != nil {
-		log.Fatalln("Error: could not connect to database; ", err)
-	}
-
-	// gormDebugMode is a package-scope variable set in the command-line parsing
-	if *gormDebugMode == true {
-		return db.Set("gorm:auto_preload", true).Debug()
+		return dbError(err)
 	}
-	return db.Set("gorm.auto_preload", true)
-}
 
-// TODO: make sure it only reads the config once
-func getDBTimeNow() string {
-	dbConfig := parseDBConfig(*configFile)
-	if dbConfig.DBType == "mysql" {
-		return "NOW()"
-	}
-	if dbConfig.DBType == "sqlite" {
-		return "date('now')"
+	// The struct tags can't vary by database, so anything dialect-specific
+	//  gets patched up afterwards
+	blobType := dialect.BlobType()
+	if blobType != "" {
+		err = db.Model(&FormFile{}).ModifyColumn("file_contents", blobType).Error
+		if err != nil {
+			return dbError(err)
+		}
 	}
-	log.Fatalln("Error: DB type was unknown when trying to work out how to get times")
-	return ""
+	return nil
 }
 
-// The compatibility of this forces a slightly awkward format
-//  "5 day"
-//  "14 day"
-func getDBFutureTimes(futureSpec string) string {
-	dbConfig := parseDBConfig(*configFile)
-	if dbConfig.DBType == "mysql" {
-		return "DATE_ADD(NOW(), INTERVAL +" + futureSpec + ")"
-	}
-	if dbConfig.DBType == "sqlite" {
-		return "date('now', '+" + futureSpec + "')"
-	}
-	log.Fatalln("Error: DB type was unknown when trying to work out how to get times")
-	return ""
+// Brings an existing database up to date with the models: adds any missing
+// tables and columns, but never changes or removes existing ones.
+func upgradeTables(db *gorm.DB) error {
+	return dbError(db.AutoMigrate(allModels...).Error)
 }
 
-func createNoodlingData(db *gorm.DB) {
+func createNoodlingData(db *gorm.DB) error {
 	nowTime := time.Now()
 	aDay, _ := time.ParseDuration("24h")
 	aYear, _ := time.ParseDuration("8760h")
@@ -82,31 +60,48 @@ func createNoodlingData(db *gorm.DB) {
 	nowPlusADayTime := nowTime.Add(aDay)
 	nowPlusAYearTime := nowTime.Add(aYear)
 
-	exception := Exception{Username: "uccaiki", SubmittedDate: &nowTime, StartDate: &nowPlusADayTime, EndDate: &nowPlusAYearTime, Service: "legion", ExceptionType: "quota", ExceptionDetail: "scratch:1TB"}
-	db.NewRecord(exception)
-	db.Create(&exception)
-	exception2 := Exception{Username: "uccaiki", SubmittedDate: &nowTime, Service: "legion", ExceptionType: "quota", ExceptionDetail: "home:500MB"}
-	db.NewRecord(exception2)
-	db.Create(&exception2)
-	exception3 := Exception{Username: "ccspapp", SubmittedDate: &nowTime, Service: "grace", ExceptionType: "queue", ExceptionDetail: "crag7day"}
-	db.NewRecord(exception3)
-	db.Create(&exception3)
+	exceptions := []Exception{
+		{Username: "uccaiki", SubmittedDate: &nowTime, StartDate: &nowPlusADayTime, EndDate: &nowPlusAYearTime, Service: "legion", ExceptionType: "quota", ExceptionDetail: "scratch:1TB"},
+		{Username: "uccaiki", SubmittedDate: &nowTime, Service: "legion", ExceptionType: "quota", ExceptionDetail: "home:500MB"},
+		{Username: "ccspapp", SubmittedDate: &nowTime, Service: "grace", ExceptionType: "queue", ExceptionDetail: "crag7day"},
+	}
+	for i := range exceptions {
+		err := db.Create(&exceptions[i]).Error
+		if err != nil {
+			return dbError(err)
+		}
+	}
+	return nil
 }
 
-func createDB() {
-	db := getDB()
-	defer db.Close()
-	createTables(db)
+func createDB(ac *appContext) error {
+	return createTables(ac.db, ac.dialect)
+}
+
+func upgradeDB(ac *appContext) error {
+	err := upgradeTables(ac.db)
+	if err != nil {
+		return err
+	}
+	err = ac.dialect.UpgradeOldTimes(ac.db, tableNames(ac.db), ac.config.location)
+	if err != nil {
+		return dbError(err)
+	}
+	return backfillFileDetails(ac)
+}
+
+func tableNames(db *gorm.DB) []string {
+	names := make([]string, len(allModels))
+	for i, model := range allModels {
+		names[i] = db.NewScope(model).TableName()
+	}
+	return names
 }
 
-func destroyDB() {
-	db := getDB()
-	defer db.Close()
-	destroyTables(db)
+func destroyDB(ac *appContext) error {
+	return destroyTables(ac.db)
 }
 
-func makeNoodles() {
-	db := getDB()
-	defer db.Close()
-	createNoodlingData(db)
+func makeNoodles(ac *appContext) error {
+	return createNoodlingData(ac.db)
 }
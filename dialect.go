@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// Everything that differs between the databases we can talk to lives
+// behind this interface, so the rest of the code can just build queries
+// without caring which one is on the other end.
+type dbDialect interface {
+	// The name to pass to gorm.Open
+	DriverName() string
+	// Takes the connection string from the config file and adds anything
+	// the driver needs to behave itself
+	ConnectionString(configured string) string
+	// SQL expression for a time column that can be compared with a time
+	// passed as a parameter
+	TimeColumn(column string) string
+	// SQL expression for a date column (e.g. Exception.EndDate) that can be
+	// compared with DateValue
+	DateColumn(column string) string
+	// SQL literal for a calendar date
+	DateValue(date time.Time) string
+	// For databases made before the exceptions' dates were dates: turns
+	// them into dates, leaving them as they were, and anything else about
+	// how older versions wrote times that needs putting right. location is
+	// the zone they were written in, where that matters. Does nothing if
+	// the dates are dates already.
+	UpgradeOldTimes(db *gorm.DB, tables []string, location *time.Location) error
+	// Column type to use for FormFile.FileContents, or "" to leave it as
+	// whatever gorm picks for a []byte
+	BlobType() string
+	// Moves on whatever hands out IDs for a table so that it won't hand out
+	// any that are already in it, for after we've inserted rows with IDs
+	// of our own choosing (e.g. in importjson)
+	SyncIDSequence(db *gorm.DB, table string) error
+}
+
+// People (and our own docs, at one point) use a few different names for
+// the same database, so these all get mapped to the name gorm wants.
+var dbTypeAliases = map[string]string{
+	"mysql":      "mysql",
+	"mariadb":    "mysql",
+	"postgres":   "postgres",
+	"postgresql": "postgres",
+	"sqlite":     "sqlite3",
+	"sqlite3":    "sqlite3",
+}
+
+func normaliseDBType(dbType string) string {
+	return dbTypeAliases[strings.ToLower(strings.TrimSpace(dbType))]
+}
+
+func getDialect(dbType string) (dbDialect, error) {
+	switch normaliseDBType(dbType) {
+	case "mysql":
+		return mysqlDialect{}, nil
+	case "postgres":
+		return postgresDialect{}, nil
+	case "sqlite3":
+		return sqliteDialect{}, nil
+	}
+	return nil, fmt.Errorf("unknown database type %q (should be one of: mysql, postgres, sqlite3)", dbType)
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) DriverName() string { return "mysql" }
+
+// We append our own parameters here so if you use any in the config file
+// with ? it won't work -- this hasn't been a problem so far
+func (mysqlDialect) ConnectionString(configured string) string {
+	// If you don't pass parseTime=True here for MySQL DBs, time.Times won't work properly.
+	//  loc used to be Local, which moved dates to the previous day for anyone
+	//  west of UTC, since they're midnight UTC: see dates.go, and
+	//  UpgradeOldTimes for what happens to times written that way
+	return configured + "?charset=utf8&parseTime=True&loc=UTC"
+}
+
+func (mysqlDialect) TimeColumn(column string) string { return column }
+
+func (mysqlDialect) DateColumn(column string) string { return "DATE(" + column + ")" }
+
+func (mysqlDialect) DateValue(date time.Time) string {
+	return "DATE('" + date.Format(dateLayout) + "')"
+}
+
+// Until the exceptions' dates were dates, we connected with loc=Local, so
+// the driver wrote every time as the local time of whoever was running the
+// tool, which we take to be the zone in the config file. All of them get
+// converted to UTC, once: it's done just before the dates become dates,
+// which is how we know it hasn't been done already. The dates themselves
+// were midnight UTC written the same way, so they're converted back to
+// that first, rather than just losing their time of day, which would move
+// them to the previous day anywhere west of UTC.
+func (mysqlDialect) UpgradeOldTimes(db *gorm.DB, tables []string, location *time.Location) error {
+	var dataType string
+	err := db.Raw("SELECT data_type FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'exceptions' AND column_name = 'end_date'").
+		Row().Scan(&dataType)
+	if err != nil || strings.ToLower(dataType) == "date" {
+		return err
+	}
+
+	rows, err := db.Raw("SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND data_type = 'datetime' AND table_name IN (?)",
+		tables).Rows()
+	if err != nil {
+		return err
+	}
+	var columns [][2]string
+	for rows.Next() {
+		var table, column string
+		err = rows.Scan(&table, &column)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		columns = append(columns, [2]string{table, column})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range columns {
+		err = mysqlLocalTimesToUTC(db, v[0], v[1], location)
+		if err != nil {
+			return err
+		}
+	}
+	// All in one statement, so the dates can't end up half done
+	alterations := make([]string, len(exceptionDateColumns))
+	for i, column := range exceptionDateColumns {
+		alterations[i] = "MODIFY " + column + " DATE NULL"
+	}
+	return db.Exec("ALTER TABLE exceptions " + strings.Join(alterations, ", ")).Error
+}
+
+// The times are read and written as text, so the driver's loc doesn't get
+// a say in what they mean.
+func mysqlLocalTimesToUTC(db *gorm.DB, table string, column string, location *time.Location) error {
+	rows, err := db.Raw(fmt.Sprintf("SELECT id, CAST(%s AS CHAR) FROM %s WHERE %s IS NOT NULL", column, table, column)).Rows()
+	if err != nil {
+		return err
+	}
+	// MySQL can't start another query on this connection until these have
+	//  all been read
+	converted := make(map[uint]string)
+	for rows.Next() {
+		var id uint
+		var text string
+		err = rows.Scan(&id, &text)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		converted[id], err = mysqlLocalTimeToUTC(text, location)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("could not understand %s.%s for ID %d: %s", table, column, id, err)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, text := range converted {
+		err = db.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ?", table, column), text, id).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The driver writes a zero time.Time as MySQL's zero date, which is left
+// as it is, since it isn't a time anywhere.
+func mysqlLocalTimeToUTC(text string, location *time.Location) (string, error) {
+	if strings.HasPrefix(text, "0000-00-00") {
+		return text, nil
+	}
+	local, err := time.ParseInLocation("2006-01-02 15:04:05.999999999", text, location)
+	if err != nil {
+		return "", err
+	}
+	return local.UTC().Format("2006-01-02 15:04:05.999999"), nil
+}
+
+// gorm would make this a longblob, which is a bit much for a form
+// (mediumblobs can hold up to 16MB)
+func (mysqlDialect) BlobType() string { return "mediumblob" }
+
+// AUTO_INCREMENT already skips past any IDs inserted explicitly
+func (mysqlDialect) SyncIDSequence(db *gorm.DB, table string) error { return nil }
+
+type postgresDialect struct{}
+
+func (postgresDialect) DriverName() string { return "postgres" }
+
+// lib/pq takes either "host=... user=..." or a postgres:// URL, and
+// handles time.Times fine without any help, so this is left alone
+func (postgresDialect) ConnectionString(configured string) string { return configured }
+
+func (postgresDialect) TimeColumn(column string) string { return column }
+
+func (postgresDialect) DateColumn(column string) string { return column }
+
+func (postgresDialect) DateValue(date time.Time) string {
+	return "DATE '" + date.Format(dateLayout) + "'"
+}
+
+// PostgreSQL's timestamps know their own zone, so only the dates need
+// changing, and a plain cast to date would use the session's time zone, so
+// this says UTC, which is what the dates were written in.
+func (postgresDialect) UpgradeOldTimes(db *gorm.DB, tables []string, location *time.Location) error {
+	for _, column := range exceptionDateColumns {
+		var dataType string
+		err := db.Raw("SELECT data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'exceptions' AND column_name = ?",
+			column).Row().Scan(&dataType)
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(dataType) == "date" {
+			continue
+		}
+		err = db.Exec(fmt.Sprintf("ALTER TABLE exceptions ALTER COLUMN %s TYPE date USING (%s AT TIME ZONE 'UTC')::date", column, column)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gorm already uses bytea for []byte, which has no practical size limit for us
+func (postgresDialect) BlobType() string { return "" }
+
+// Postgres sequences know nothing about rows inserted with explicit IDs,
+// and would happily hand those IDs out again
+func (postgresDialect) SyncIDSequence(db *gorm.DB, table string) error {
+	return db.Exec(fmt.Sprintf(
+		"SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s",
+		table, table)).Error
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) DriverName() string { return "sqlite3" }
+
+// Just a filename
+func (sqliteDialect) ConnectionString(configured string) string { return configured }
+
+// SQLite has no real time type: the driver stores a time.Time as text like
+// "2030-01-31 00:00:00+00:00", which only sorts correctly against other text
+// in exactly the same format and zone. datetime() and date() turn both sides
+// of every comparison into "YYYY-MM-DD HH:MM:SS" or "YYYY-MM-DD" in UTC, so
+// they compare properly.
+func (sqliteDialect) TimeColumn(column string) string {
+	return "datetime(" + column + ")"
+}
+
+func (sqliteDialect) DateColumn(column string) string {
+	return "date(" + column + ")"
+}
+
+func (sqliteDialect) DateValue(date time.Time) string {
+	return "date('" + date.Format(dateLayout) + "')"
+}
+
+// Column types can't be changed in SQLite, and don't really mean anything
+// anyway: the old values are midnight UTC, which DateColumn copes with, and
+// times have always been written with their zone.
+func (sqliteDialect) UpgradeOldTimes(db *gorm.DB, tables []string, location *time.Location) error {
+	return nil
+}
+
+// SQLite doesn't really do column types, and can't alter them anyway
+func (sqliteDialect) BlobType() string { return "" }
+
+// INTEGER PRIMARY KEY always carries on from the largest ID in the table
+func (sqliteDialect) SyncIDSequence(db *gorm.DB, table string) error { return nil }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+// Old MySQL databases have times in local time, here London's, which
+// upgradedb turns into UTC, including the dates, which were midnight UTC.
+func TestMySQLLocalTimeToUTC(t *testing.T) {
+	london := loadLondon(t)
+	for _, v := range []struct {
+		local string
+		want  string
+	}{
+		{"2026-03-29 00:00:00", "2026-03-29 00:00:00"}, // Dates, in GMT
+		{"2026-03-30 01:00:00", "2026-03-30 00:00:00"}, // and in BST
+		{"2026-10-26 00:00:00", "2026-10-26 00:00:00"},
+		{"2026-06-15 14:30:00", "2026-06-15 13:30:00"},
+		{"2026-06-15 00:30:00.25", "2026-06-14 23:30:00.25"},
+		{"2026-12-15 14:30:00", "2026-12-15 14:30:00"},
+		{"0000-00-00 00:00:00", "0000-00-00 00:00:00"},
+	} {
+		got, err := mysqlLocalTimeToUTC(v.local, london)
+		if err != nil {
+			t.Errorf("%s: %s", v.local, err)
+			continue
+		}
+		if got != v.want {
+			t.Errorf("%s in London: got %s, want %s", v.local, got, v.want)
+		}
+	}
+
+	_, err := mysqlLocalTimeToUTC("15/06/2026 14:30", london)
+	if err == nil {
+		t.Error("a time that isn't in MySQL's format should not have been converted")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// These are the exit codes scripts can rely on: they're also listed in the
+// README, so if you add or change one, change it there too.
+const (
+	exitOK                = 0
+	exitGeneral           = 1 // Anything not covered below
+	exitUsage             = 2 // The command line didn't make sense
+	exitConfig            = 3 // Couldn't read or understand the config file
+	exitNotFound          = 4 // No exception/file/etc with that ID
+	exitInvalidTransition = 5 // The status change isn't allowed without --force
+	exitValidation        = 6 // Bad input: username, service, dates, etc
+	exitDatabase          = 7 // The database refused or failed to do something
+	exitInconsistent      = 8 // fsck found problems and didn't repair them, or a stored file or backup is damaged
+)
+
+// An error that knows what exit code it should end the program with.
+type classedError struct {
+	exitCode int
+	err      error
+}
+
+func (e *classedError) Error() string { return e.err.Error() }
+func (e *classedError) Unwrap() error { return e.err }
+
+func classify(exitCode int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classedError{exitCode: exitCode, err: err}
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return classify(exitUsage, fmt.Errorf(format, args...))
+}
+
+func configErrorf(format string, args ...interface{}) error {
+	return classify(exitConfig, fmt.Errorf(format, args...))
+}
+
+func notFoundErrorf(format string, args ...interface{}) error {
+	return classify(exitNotFound, fmt.Errorf(format, args...))
+}
+
+func transitionErrorf(format string, args ...interface{}) error {
+	return classify(exitInvalidTransition, fmt.Errorf(format, args...))
+}
+
+func validationErrorf(format string, args ...interface{}) error {
+	return classify(exitValidation, fmt.Errorf(format, args...))
+}
+
+// For the errors that come back from the filterSubmitted* functions and
+// similar, which are already perfectly good messages.
+func validationError(err error) error {
+	return classify(exitValidation, err)
+}
+
+// Wraps an error from gorm. Passes nil through untouched, so you can just
+// do `return dbError(db.Save(thing).Error)`.
+func dbError(err error) error {
+	return classify(exitDatabase, err)
+}
+
+func exitCodeFor(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ce *classedError
+	if errors.As(err, &ce) {
+		return ce.exitCode
+	}
+	return exitGeneral
+}
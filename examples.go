@@ -2,8 +2,6 @@ package main
 
 import (
 	"fmt"
-	"golang.org/x/crypto/ssh/terminal"
-	"os"
 	"regexp"
 )
 
@@ -20,50 +18,53 @@ var colorMap = map[string]string{
 	"RESET":   "\u001b[0m",
 }
 
+// Colours are marked in the examples as %^NAME%^, with names from colorMap.
+var reColor = regexp.MustCompile(`%\^(BOLD|RESET|BLACK|RED|GREEN|YELLOW|BLUE|MAGENTA|CYAN|WHITE)%\^`)
+
 func printExamples() {
-	if terminal.IsTerminal(int(os.Stdout.Fd())) {
+	if useColor {
 		fmt.Println(sarColors(examplesString))
 	} else {
 		fmt.Println(stripColors(examplesString))
 	}
 }
 
-// TODO: colors
 func sarColors(a_string string) string {
-	return a_string
+	return reColor.ReplaceAllStringFunc(a_string, func(marker string) string {
+		return colorMap[reColor.FindStringSubmatch(marker)[1]]
+	})
 }
 
 func stripColors(a_string string) string {
-	reColor := regexp.MustCompile("%^(BOLD|RESET|BLACK|RED|GREEN|YELLOW|BLUE|MAGENTA|CYAN|WHITE)%^")
 	return reColor.ReplaceAllString(a_string, "")
 }
 
 var examplesString = `
-Getting Info
+%^BOLD%^Getting Info%^RESET%^
 
-	exceptions list
+	%^GREEN%^exceptions list%^RESET%^
 		List all exceptions currently in the database and not marked 
 		  "deleted" (under soft-delete scheme)
 		Can also list more specific categories: default is "exceptions list all"
 	
-	exceptions details 4
+	%^GREEN%^exceptions details 4%^RESET%^
 	  Print detailed information about the exception with ID "4".
 		Note: "detail" and "info" can also be used here, they do 
 		  the same thing.
 	
-Submitting a New Exception
+%^BOLD%^Submitting a New Exception%^RESET%^
 
-	exceptions submit --username=ccspapp --service=grace --type=quota --detail="25TB Scratch"
+	%^GREEN%^exceptions submit --username=ccspapp --service=grace --type=quota --detail="25TB Scratch"%^RESET%^
 	  Logs a new exception, starting today and ending in a year, for Grace, with 
 			the text given in the detail option.
 		Note that "type" is currently a free string, but "quota" and "queue" are expected types.
 
-Statuses
+%^BOLD%^Statuses%^RESET%^
 
   Exceptions are expected to go through the following statuses:
-	  - undecided
-		- approved or rejected (rejected stops here)
-		- implemented
+	  - %^YELLOW%^undecided%^RESET%^
+		- %^CYAN%^approved%^RESET%^ or rejected (rejected stops here)
+		- %^GREEN%^implemented%^RESET%^
 		- removed
 	
 	These are set by a command of the same name:
@@ -6,11 +6,10 @@ import (
 	"log"
 	"os"
 	"os/user"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/mysql"
-	_ "github.com/jinzhu/gorm/dialects/sqlite"
 
 	"github.com/olekukonko/tablewriter"
 )
@@ -19,24 +18,69 @@ type Exception struct {
 	// The gorm.Model inclusion here adds a number of fields that are automatically
 	//   used and updated by gorm: ID, CreatedAt, UpdatedAt, and DeletedAt
 	gorm.Model
-	Username        string         `gorm:"type:varchar(10);not null"`
-	SubmittedDate   *time.Time     `gorm:"default:NULL"`
-	StartDate       *time.Time     `gorm:"default:NULL"`
-	EndDate         *time.Time     `gorm:"default:NULL"`
+	Username string `gorm:"type:varchar(10);not null"`
+	// These are calendar dates, always midnight UTC: see dates.go
+	SubmittedDate   *time.Time     `gorm:"type:date;default:NULL"`
+	StartDate       *time.Time     `gorm:"type:date;default:NULL"`
+	EndDate         *time.Time     `gorm:"type:date;default:NULL"`
 	Service         string         `gorm:"type:varchar(16);not null"`
 	ExceptionType   string         `gorm:"type:varchar(128);not null"`
 	ExceptionDetail string         `gorm:"type:varchar(512);not null"`
 	FormFiles       []FormFile     `gorm:"foreignkey:ExceptionID"`
 	Comments        []Comment      `gorm:"foreignkey:ExceptionID"`
 	StatusChanges   []StatusChange `gorm:"foreignkey:ExceptionID"`
+	AuditEntries    []AuditEntry   `gorm:"foreignkey:ExceptionID"`
 	Status          string         `gorm:"default:'(none)'; not null"`
 }
 
+// Whatever zone the database driver hands the dates back in (or someone
+// hands them to us in, in an old dump), they're kept as midnight UTC on
+// the same day, so that formatting them always gives the right date.
+func (exception *Exception) normaliseDates() {
+	for _, date := range []**time.Time{&exception.SubmittedDate, &exception.StartDate, &exception.EndDate} {
+		if *date != nil {
+			normalised := calendarDate(**date)
+			*date = &normalised
+		}
+	}
+}
+
+// Called by gorm
+func (exception *Exception) AfterFind() error {
+	exception.normaliseDates()
+	return nil
+}
+
+// Called by gorm
+func (exception *Exception) BeforeSave() error {
+	exception.normaliseDates()
+	return nil
+}
+
 type FormFile struct {
 	gorm.Model
-	ExceptionID  uint
-	FileName     string `gorm:"type:text"`
-	FileContents []byte `gorm:"type:mediumblob"` // Note: in MySQL 5.5 and 8.0 at least, mediumblobs can hold a maximum of 16 megabytes. This *SHOULD* be fine for all our cases.
+	ExceptionID uint
+	FileName    string `gorm:"type:text"`
+	// Only used by the "database" store: use appContext.fileContents rather
+	//  than reading this directly
+	FileContents []byte // Column type is set per-database in createTables: see BlobType in dialect.go
+	// Which attachmentStore the contents are in, and what it calls them.
+	//  Left out of dumps, which always have the contents themselves, so
+	//  they can be imported whatever the store is.
+	Storage    string `gorm:"type:varchar(16)" json:"-"`
+	StorageKey string `gorm:"type:varchar(255)" json:"-"`
+	// How the contents are compressed, if they are
+	Compression string `gorm:"type:varchar(8)"`
+	// These are all of the contents as they were attached, before any
+	//  compression: see verifyFile
+	SHA256   string `gorm:"type:char(64)"`
+	Size     int64
+	MIMEType string `gorm:"type:varchar(255)"`
+	// e.g. "original application", "renewal form"
+	Description string `gorm:"type:text"`
+	// Set on the old version when a file is replaced, which is kept, but
+	//  left out of form list (without --history), download-for and details
+	ReplacedByID *uint
 }
 
 type Comment struct {
@@ -44,6 +88,11 @@ type Comment struct {
 	ExceptionID uint
 	CommentBy   string `gorm:"type:varchar(10); not null"`
 	CommentText string `gorm:"type:text; not null"`
+	// Set on replies, to the comment they're replying to
+	ParentID *uint
+	// Set on the old versions kept when a comment is edited, to the
+	//  comment they're old versions of: see comments.go
+	ReplacedByID *uint
 }
 
 type StatusChange struct {
@@ -54,6 +103,16 @@ type StatusChange struct {
 	Changer     string `gorm:"type:varchar(10); not null"`
 }
 
+// For recording things done to an exception that aren't status changes or
+// comments -- e.g. repairs made by fsck.
+type AuditEntry struct {
+	gorm.Model
+	ExceptionID uint
+	Action      string `gorm:"type:varchar(32); not null"`
+	Detail      string `gorm:"type:text; not null"`
+	Actor       string `gorm:"type:varchar(10); not null"`
+}
+
 // This contains a map that determines which statuses can become which other
 //
 //	statuses. It returns true if a state change is allowed, false otherwise.
@@ -79,12 +138,17 @@ func isValidChange(oldStatus string, newStatus string) bool {
 }
 
 // Pulls an Exception from the database, by ID (primary key).
-func GetException(id uint) *Exception {
-	db := getDB()
-	defer db.Close()
+// Associations are not loaded: use Related or Preload if you need them.
+func GetException(db *gorm.DB, id uint) (*Exception, error) {
 	exception := &Exception{}
-	db.Set("gorm:auto_preload", true).First(&exception, id)
-	return exception
+	err := db.First(exception, id).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, notFoundErrorf("no record of exception %d", id)
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return exception, nil
 }
 
 // This was added relatively late, because it seemed like the wrong thing
@@ -103,32 +167,35 @@ func (exception *Exception) GetStatus() string {
 //	status update and checking its new status field.
 //
 // Note that this is faster if preloading has been done, but doesn't require it.
-func (exception *Exception) GetTrackedStatus() string {
-	db := getDB()
-	defer db.Close()
-
+func (exception *Exception) GetTrackedStatus(db *gorm.DB) string {
 	// If the exception status changes have been preloaded correctly,
 	//   the db and the object should agree on the number of changes
 	// If not, we have to grab them ourselves
 
 	canonicalStatusChangeCount := db.Model(exception).Association("StatusChanges").Count()
 
-	if canonicalStatusChangeCount == 0 {
-		return "(none)"
+	if canonicalStatusChangeCount != len(exception.StatusChanges) {
+		var statusChanges []StatusChange
+		db.Model(exception).Related(&statusChanges)
+		return trackedStatusFrom(statusChanges)
 	}
 
-	var statusChanges []StatusChange
-	var lastStatusChange StatusChange
+	return trackedStatusFrom(exception.StatusChanges)
+}
 
-	if canonicalStatusChangeCount != len(exception.StatusChanges) {
-		// Currently this db call orders *all* the statusChanges --
-		//  I'm not sure how to change the query line to make it
-		//  stop doing that but it seems like it should be possible >:T
-		db.Model(exception).Related(&statusChanges).Last(&lastStatusChange)
-	} else {
-		lastStatusChange = exception.StatusChanges[canonicalStatusChangeCount-1]
+// The status the last of a set of status changes left an exception in.
+// Goes by ID rather than position, in case they weren't loaded in order.
+func trackedStatusFrom(statusChanges []StatusChange) string {
+	if len(statusChanges) == 0 {
+		return "(none)"
 	}
 
+	lastStatusChange := statusChanges[0]
+	for _, v := range statusChanges {
+		if v.ID > lastStatusChange.ID {
+			lastStatusChange = v
+		}
+	}
 	return lastStatusChange.NewStatus
 }
 
@@ -139,195 +206,232 @@ func (exception *Exception) GetTrackedStatus() string {
 //	all gorm's queries ignore the entry by default.
 //
 // The data will still be in the database.
-func SoftDeleteException(id uint) []error {
-	db := getDB()
-	defer db.Close()
-	exception := &Exception{}
-	db.Set("gorm:auto_preload", true).First(&exception, id)
-	if exception.ID == 0 {
-		return []error{errors.New(fmt.Sprintf("Could not find exception with id %d", id))}
+func SoftDeleteException(db *gorm.DB, id uint) error {
+	exception, err := GetException(db, id)
+	if err != nil {
+		return err
 	}
-	return db.Delete(&exception).GetErrors()
+	return dbError(db.Delete(exception).Error)
 }
 
 // (CLI entry point for SoftDeletion.)
-func edelete(ID uint) {
-	errors := SoftDeleteException(ID)
-	if len(errors) != 0 {
-		log.Fatal(errors)
-	}
-	return
+func edelete(ac *appContext, ID uint) error {
+	return SoftDeleteException(ac.db, ID)
 }
 
-func (exception *Exception) ChangeStatusTo(newStatus string, checkChangeValidity bool) error {
+func (exception *Exception) ChangeStatusTo(db *gorm.DB, newStatus string, checkChangeValidity bool) error {
 	currentStatus := exception.GetStatus()
 	if (!checkChangeValidity) && (!isValidChange(currentStatus, newStatus)) {
-		return errors.New(fmt.Sprintf("Proposed status change (%s -> %s) is invalid -- use -f to force", currentStatus, newStatus))
+		return transitionErrorf("proposed status change (%s -> %s) is invalid -- use -f to force", currentStatus, newStatus)
 	}
 
-	currentUser, err := user.Current()
+	username, err := currentUsername()
 	if err != nil {
-		panic("Could not get the current username")
+		return err
 	}
 	statusChange := &StatusChange{
 		ExceptionID: exception.ID,
 		OldStatus:   currentStatus,
 		NewStatus:   newStatus,
-		Changer:     currentUser.Username,
+		Changer:     username,
 	}
 
-	// See the note on GetStatus
-	exception.Status = newStatus
+	// These two have to happen together, or the Status field and the
+	//  StatusChange history disagree (see the note on GetStatus), so
+	//  db should be a transaction -- see appContext.inTransaction
+	err = db.Create(statusChange).Error
+	if err != nil {
+		return dbError(err)
+	}
 
-	db := getDB()
-	defer db.Close()
-	db.Create(statusChange)
-	db.NewRecord(statusChange)
-	db.Save(exception)
+	return dbError(db.Model(exception).Update("status", newStatus).Error)
+}
 
-	return nil
+func (exception *Exception) AddComment(db *gorm.DB, text string) (uint, error) {
+	username, err := currentUsername()
+	if err != nil {
+		return 0, err
+	}
+	comment := &Comment{ExceptionID: exception.ID, CommentText: text, CommentBy: username}
+
+	err = db.Save(comment).Error
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return comment.ID, nil
 }
 
-func (exception *Exception) AddComment(text string) (uint, error) {
-	// TODO: refactor this and the comment() function together
+// Adds an AuditEntry against an exception ID. This takes an ID rather than
+// being a method on Exception because fsck needs to record things against
+// IDs whose exceptions no longer exist.
+func recordAudit(db *gorm.DB, exceptionID uint, action string, detail string) error {
+	username, err := currentUsername()
+	if err != nil {
+		return err
+	}
+	entry := &AuditEntry{ExceptionID: exceptionID, Action: action, Detail: detail, Actor: username}
+	return dbError(db.Create(entry).Error)
+}
 
+func currentUsername() (string, error) {
 	currentUser, err := user.Current()
 	if err != nil {
-		panic("could not get current user name")
+		return "", fmt.Errorf("could not get the current username: %s", err)
 	}
-	currentUsername := currentUser.Username
-	comment := &Comment{ExceptionID: exception.ID, CommentText: text, CommentBy: currentUsername}
-
-	db := getDB()
-	defer db.Close()
-	db.Save(comment)
-	return comment.ID, nil
+	return currentUser.Username, nil
 }
 
-func (exception *Exception) DurationRemaining() (*time.Duration, string) {
+// An exception lasts from the start of its start date to the end of its
+// end date, in the configured time zone (see expiresAt).
+func (exception *Exception) DurationRemaining(now time.Time, location *time.Location) (*time.Duration, string) {
 	if exception.EndDate == nil || exception.StartDate == nil {
 		return nil, "--"
 	}
 
-	if time.Now().After(*exception.EndDate) {
+	if !now.Before(expiresAt(*exception.EndDate, location)) {
 		return nil, "finished"
 	}
 
-	if time.Now().Before(*exception.StartDate) {
+	if now.Before(startsAt(*exception.StartDate, location)) {
 		return nil, "not started yet"
 	}
 
-	duration := time.Until(*exception.EndDate)
+	duration := expiresAt(*exception.EndDate, location).Sub(now)
 	return &duration, ""
 }
 
-func undecide(ID uint, force bool) {
-	exception := GetException(ID)
-	err := exception.ChangeStatusTo("undecided", force)
+func undecide(ac *appContext, ID uint, force bool) error {
+	exception, err := GetException(ac.db, ID)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return exception.ChangeStatusTo(ac.db, "undecided", force)
 }
 
-func approve(ID uint, force bool) {
-	exception := GetException(ID)
-	err := exception.ChangeStatusTo("approved", force)
+func approve(ac *appContext, ID uint, force bool) error {
+	exception, err := GetException(ac.db, ID)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return exception.ChangeStatusTo(ac.db, "approved", force)
 }
 
-func reject(ID uint, force bool) {
-	exception := GetException(ID)
-	err := exception.ChangeStatusTo("rejected", force)
+func reject(ac *appContext, ID uint, force bool) error {
+	exception, err := GetException(ac.db, ID)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return exception.ChangeStatusTo(ac.db, "rejected", force)
 }
 
-func implement(ID uint, force bool) {
-	exception := GetException(ID)
-	err := exception.ChangeStatusTo("implemented", force)
+func implement(ac *appContext, ID uint, force bool) error {
+	exception, err := GetException(ac.db, ID)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return exception.ChangeStatusTo(ac.db, "implemented", force)
 }
 
-func remove(ID uint, force bool) {
-	exception := GetException(ID)
-	err := exception.ChangeStatusTo("removed", force)
+func remove(ac *appContext, ID uint, force bool) error {
+	exception, err := GetException(ac.db, ID)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return exception.ChangeStatusTo(ac.db, "removed", force)
 }
 
-func notYetImplemented() {
-	log.Fatal("This thing not yet implemented.\n")
-	panic("!")
+func notYetImplemented() error {
+	return errors.New("this thing is not yet implemented")
 }
 
-func list(kind string) {
-	timeNow := getDBTimeNow()
+func list(ac *appContext, kind string) error {
+	// An exception ends at the end of its end date (see expiresAt), so it's
+	//  only overdue once it's before today
+	today := ac.dialect.DateValue(ac.today())
+	startDate := ac.dialect.DateColumn("start_date")
+	endDate := ac.dialect.DateColumn("end_date")
 
 	// In theory you'd use these to determine unset but you can just use zero instead
 	//zeroTime := "FROM_UNIXTIME(0)" // MySQL
 	//zeroTime := "date(0, 'unixepoch')" // SQLite (I think)
 
-	db := getDB()
-	defer db.Close()
+	db := ac.db
 
 	// *listService is a CLI arg
 	if *listService != "" {
-		db = db.Where("service = '" + (*listService) + "'")
+		db = db.Where("service = ?", *listService)
+	}
+
+	// So are these
+	for _, v := range []struct {
+		flag, text, condition string
+	}{
+		{"--starts-after", *listStartsAfter, startDate + " > "},
+		{"--starts-before", *listStartsBefore, startDate + " < "},
+		{"--ends-after", *listEndsAfter, endDate + " > "},
+		{"--ends-before", *listEndsBefore, endDate + " < "},
+	} {
+		if v.text == "" {
+			continue
+		}
+		date, err := ac.dateParser().parse(v.text)
+		if err != nil {
+			return validationErrorf("could not parse %s: %s", v.flag, err)
+		}
+		db = db.Where(v.condition + ac.dialect.DateValue(date))
 	}
 
 	var listSet []Exception
 	switch kind {
 	case "all":
-		db.Find(&listSet)
-		printExceptionTableSummary(listSet)
+		// No extra conditions
 	case "pending":
-		db.Where(timeNow + " < start_date AND status = 'approved'").Find(&listSet)
-		printExceptionTableSummary(listSet)
+		db = db.Where(today + " < " + startDate + " AND status = 'approved'")
 	case "undecided":
-		db.Where("status = 'undecided'").Find(&listSet)
-		printExceptionTableSummary(listSet)
+		db = db.Where("status = 'undecided'")
 	case "approved":
-		db.Where("status = 'approved'").Find(&listSet)
-		printExceptionTableSummary(listSet)
+		db = db.Where("status = 'approved'")
+	case "rejected":
+		db = db.Where("status = 'rejected'")
 	case "needed":
-		db.Where("status = 'approved' AND start_date > " + timeNow).Find(&listSet)
-		printExceptionTableSummary(listSet)
+		db = db.Where("status = 'approved' AND " + startDate + " > " + today)
 	case "active":
 		// "active" is synonymous with "implemented" here to make the interface make... some manner of sense
 		// so we fall through to it
 		// (go case statements do not otherwise fall through)
 		fallthrough
 	case "implemented":
-		db.Where("status = 'implemented'").Find(&listSet)
-		printExceptionTableSummary(listSet)
+		db = db.Where("status = 'implemented'")
 	case "overdue":
-		db.Where("status = 'implemented' AND end_date < " + timeNow).Find(&listSet)
-		printExceptionTableSummary(listSet)
+		db = db.Where("status = 'implemented' AND " + endDate + " < " + today)
 	case "removed":
-		db.Where("status = 'removed'").Find(&listSet)
-		printExceptionTableSummary(listSet)
+		db = db.Where("status = 'removed'")
 	case "todo":
-		db.Where("(status = 'implemented' AND end_date < " + timeNow + ") OR (status = 'approved' AND start_date > " + timeNow + ") OR (status = 'undecided')").Find(&listSet)
-		printExceptionTableSummary(listSet)
+		db = db.Where("(status = 'implemented' AND " + endDate + " < " + today + ") OR (status = 'approved' AND " + startDate + " > " + today + ") OR (status = 'undecided')")
+	case "overlapping":
+		// Found after the query, below: see overlappingExceptions
+		db = db.Where("status NOT IN (?)", nonOverlappingStatuses)
 	case "inconsistent":
 		// Ideally we'd move this out into a call like IsInconsistent and then run for each Exception
 		//  but that would be *much* slower
 		// I removed a lot of possibles here that relied on no-longer-existent fields. More checking
 		//  might be useful.
-		db.Where("(submitted_date IS NULL) OR " +
+		db = db.Where("(submitted_date IS NULL) OR " +
 			"(start_date IS NULL AND end_date IS NOT NULL) OR " +
-			"(start_date > end_date) " +
-			"").Find(&listSet)
-		printExceptionTableSummary(listSet)
+			"(" + startDate + " > " + endDate + ") " +
+			"")
 	default:
-		notYetImplemented()
+		return notYetImplemented()
 	}
+
+	err := db.Find(&listSet).Error
+	if err != nil {
+		return dbError(err)
+	}
+	if kind == "overlapping" {
+		listSet = overlappingExceptions(listSet)
+	}
+	return printExceptionTableSummary(ac, listSet)
 }
 
 //var epochZero = time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC)
@@ -340,13 +444,48 @@ func stringFromDate(timeIn *time.Time) string {
 	}
 }
 
-func printExceptionTableSummary(exceptions []Exception) {
-	db := getDB()
-	defer db.Close()
+// Counts the rows in one of the tables hanging off Exception (comments,
+// files, etc) for each of a set of exceptions, in one query rather than
+// one per exception.
+func countPerException(db *gorm.DB, model interface{}, exceptionIDs []uint) (map[uint]int, error) {
+	var rows []struct {
+		ExceptionID uint
+		Count       int
+	}
+	err := db.Model(model).
+		Select("exception_id, COUNT(*) AS count").
+		Where("exception_id IN (?)", exceptionIDs).
+		Group("exception_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	counts := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		counts[row.ExceptionID] = row.Count
+	}
+	return counts, nil
+}
 
+func printExceptionTableSummary(ac *appContext, exceptions []Exception) error {
+	db := ac.db
 	if len(exceptions) == 0 {
 		log.Print("No such records found.")
-		return
+		return nil
+	}
+
+	exceptionIDs := make([]uint, 0, len(exceptions))
+	for _, ex := range exceptions {
+		exceptionIDs = append(exceptionIDs, ex.ID)
+	}
+	commentCounts, err := countPerException(db.Where("replaced_by_id IS NULL"), &Comment{}, exceptionIDs)
+	if err != nil {
+		return err
+	}
+	attachmentCounts, err := countPerException(db.Where("replaced_by_id IS NULL"), &FormFile{}, exceptionIDs)
+	if err != nil {
+		return err
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
@@ -355,9 +494,9 @@ func printExceptionTableSummary(exceptions []Exception) {
 
 	for _, ex := range exceptions {
 		var statusString string
-		numComments := db.Model(&ex).Association("Comments").Count()
-		numAttachments := db.Model(&ex).Association("FormFiles").Count()
-		statusString = ex.GetStatus()
+		numComments := commentCounts[ex.ID]
+		numAttachments := attachmentCounts[ex.ID]
+		statusString = ac.coloredStatus(&ex)
 		table.Append([]string{fmt.Sprintf("%d", ex.ID),
 			ex.Username,
 			statusString,
@@ -372,43 +511,34 @@ func printExceptionTableSummary(exceptions []Exception) {
 		})
 	}
 	table.Render()
+	return nil
 }
 
-func submitWithAllParts(username string, submitDateString string, startDateString string, endDateString string, service string, exceptionType string, details string) (uint, error) {
+func submitWithAllParts(ac *appContext, username string, submitDateString string, startDateString string, endDateString string, service string, exceptionType string, details string, allowOverlap bool, force bool) (uint, error) {
 	// First convert dates into proper formats
-	var submitDate time.Time
-	var startDate time.Time
-	var endDate time.Time
-	var err error
-
-	submitDate, err = time.Parse("2006-01-02", submitDateString)
-	if err != nil {
-		log.Fatalln("Could not parse submit date")
-	}
-
-	startDate, err = time.Parse("2006-01-02", startDateString)
-	if err != nil {
-		log.Fatalln("Could not parse start date")
-	}
-
-	endDate, err = time.Parse("2006-01-02", endDateString)
+	submitDate, startDate, endDate, err := ac.dateParser().exceptionDates(submitDateString, startDateString, endDateString)
 	if err != nil {
-		log.Fatalln("Could not parse end date")
+		return 0, err
 	}
 
 	username, err = filterSubmittedUsername(username)
 	if err != nil {
-		log.Fatalln(err)
+		return 0, validationError(err)
 	}
 
 	service, err = filterSubmittedService(service)
 	if err != nil {
-		log.Fatalln(err)
+		return 0, validationError(err)
 	}
 
 	exceptionType, err = filterSubmittedExceptionType(exceptionType)
 	if err != nil {
-		log.Fatalln(err)
+		return 0, validationError(err)
+	}
+
+	problems := dateProblems(submitDate, startDate, endDate, exceptionType, ac.config.maxDurations, ac.today())
+	if len(problems) != 0 && !force {
+		return 0, validationErrorf("%s -- use --force to submit it anyway", strings.Join(problems, "; "))
 	}
 
 	// Then create the exception
@@ -420,104 +550,115 @@ func submitWithAllParts(username string, submitDateString string, startDateStrin
 		ExceptionType:   exceptionType,
 		ExceptionDetail: details}
 
-	db := getDB()
-	defer db.Close()
-	db.NewRecord(exception)
-	db.Create(&exception)
-
-	exception.ChangeStatusTo("undecided", true)
-	return exception.ID, nil
-}
-
-func comment(id uint, commentText string) (uint, error) {
-	db := getDB()
-	defer db.Close()
-
-	exception := &Exception{}
-
-	exRetrErrors := db.First(&exception, id).GetErrors()
-
-	if exception.ID == 0 {
-		log.Fatalln("No record of that exception.")
-		return 0, errors.New("No record of that exception.")
+	db := ac.db
+	overlapping, err := checkForOverlaps(ac, &exception, allowOverlap)
+	if err != nil {
+		return 0, err
 	}
 
-	for _, v := range exRetrErrors {
-		fmt.Println(v)
+	err = db.Create(&exception).Error
+	if err != nil {
+		return 0, dbError(err)
 	}
 
-	// commentTextArg is a command line option set in cli.go
-	var err error
-	if commentText == "" {
-		commentText, err = getTextFromEditor()
+	err = exception.ChangeStatusTo(db, "undecided", true)
+	if err != nil {
+		return 0, err
+	}
+	err = recordOverlapAllowed(db, exception.ID, overlapping)
+	if err != nil {
+		return 0, err
+	}
+	if len(problems) != 0 {
+		_, err = exception.AddComment(db, "Submitted with --force, although "+strings.Join(problems, "; ")+".")
 		if err != nil {
 			return 0, err
 		}
 	}
+	return exception.ID, nil
+}
 
-	currentUser, err := user.Current()
-	currentUsername := currentUser.Username
-	comment := &Comment{ExceptionID: id, CommentText: commentText, CommentBy: currentUsername}
+func comment(ac *appContext, id uint, commentText string) (uint, error) {
+	exception, err := GetException(ac.db, id)
+	if err != nil {
+		return 0, err
+	}
 
-	db.Save(comment)
-	return comment.ID, nil
+	return exception.AddComment(ac.db, commentText)
 }
 
-func timeRemaining(exception *Exception) string {
-	remaining, msg := exception.DurationRemaining()
+// Gets comment text from the command line if given, or from an editor if not,
+// with the lines in about shown under it. This is kept separate from comment()
+// so that the editor can be opened before any transaction starts.
+func commentTextFromArgOrEditor(commentText string, about []string) (string, error) {
+	if commentText != "" {
+		return commentText, nil
+	}
+	return getTextFromEditor("", about)
+}
+
+// Counted in calendar days rather than 24-hour periods, so that days that
+// are 23 or 25 hours long because the clocks change don't throw it out.
+func timeRemaining(ac *appContext, exception *Exception) string {
+	remaining, msg := exception.DurationRemaining(ac.now, ac.config.location)
 
 	if remaining == nil {
 		return msg
 	}
 
-	return fmt.Sprintf("%d days", int(remaining.Hours()/24))
+	days := daysBetween(ac.today(), *exception.EndDate)
+	switch days {
+	case 0:
+		return "last day today"
+	case 1:
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", days)
 }
 
-func details(id uint) {
-	db := getDB()
-	defer db.Close()
-	exception := &Exception{}
-	var comments []Comment
+func details(ac *appContext, id uint) error {
+	db := ac.db
 	var files []FormFile
 	var statusChanges []StatusChange
 
-	errors := db.Set("gorm:auto_preload", true).First(&exception, id).GetErrors()
-
-	if exception.ID == 0 {
-		log.Print("No record of that exception.")
-		return
-	}
-
-	if len(errors) != 0 {
-		for _, v := range errors {
-			fmt.Println(v)
-		}
-		log.Fatalln("Errors getting exception from DB! See above.")
+	// The associations are fetched separately below, so no preloading here
+	exception, err := GetException(db, id)
+	if err != nil {
+		return err
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetBorder(false)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
-	table.SetColWidth(80)
+	// Comments are wrapped as they're rendered, and the table would
+	// run all their lines together if it wrapped them again
+	table.SetAutoWrapText(false)
+	const textWidth = 80
 
-	timeRemaining := timeRemaining(exception)
+	timeRemaining := timeRemaining(ac, exception)
+	if ac.isOverdue(exception) {
+		timeRemaining = colorize(timeRemaining, "RED")
+	}
 
 	data := [][]string{
 		[]string{"ID", fmt.Sprint(exception.ID)},
 		[]string{"Username", exception.Username},
 		[]string{"Service", exception.Service},
 		[]string{"Type", exception.ExceptionType},
-		[]string{"Detail", exception.ExceptionDetail},
+		[]string{"Detail", wrapText(exception.ExceptionDetail, textWidth)},
 		[]string{"Created", exception.CreatedAt.Format("2006-01-02 15:04:05 MST")},
 		[]string{"Updated", exception.UpdatedAt.Format("2006-01-02 15:04:05 MST")},
 		[]string{"Submitted", stringFromDate(exception.SubmittedDate)},
 		[]string{"Starts", stringFromDate(exception.StartDate)},
 		[]string{"Ends", stringFromDate(exception.EndDate)},
 		[]string{"Remaining", timeRemaining},
-		[]string{"Status", exception.GetStatus()},
+		[]string{"Status", ac.coloredStatus(exception)},
 	}
 
-	db.Model(&exception).Related(&statusChanges)
+	err = db.Model(exception).Related(&statusChanges).Error
+	if err != nil {
+		return dbError(err)
+	}
 	if len(statusChanges) == 0 {
 		data = append(data, []string{"Status Updates", "(none)"})
 	} else {
@@ -527,28 +668,56 @@ func details(id uint) {
 		}
 	}
 
-	db.Model(&exception).Related(&files)
+	// No need to load the contents just to say how big they are
+	err = db.Model(exception).Select("id, file_name, size, description").Where("replaced_by_id IS NULL").Related(&files).Error
+	if err != nil {
+		return dbError(err)
+	}
 	if len(files) == 0 {
 		data = append(data, []string{"File", "(none)"})
 	} else {
 		fileRowLabel := "File"
 		for _, v := range files {
-			data = append(data, []string{fileRowLabel, fmt.Sprintf("%s (%d bytes)", v.FileName, len(v.FileContents))})
+			fileText := fmt.Sprintf("%s (%d bytes)", v.FileName, v.Size)
+			if v.Description != "" {
+				fileText += ": " + v.Description
+			}
+			data = append(data, []string{fileRowLabel, wrapText(fileText, textWidth)})
 			fileRowLabel = ""
 		}
 	}
 
-	db.Model(&exception).Related(&comments)
-	if len(comments) == 0 {
+	comments, err := getCommentsForException(db, exception.ID)
+	if err != nil {
+		return err
+	}
+	threaded := threadComments(comments, false)
+	if len(threaded) == 0 {
 		data = append(data, []string{"Comment", "(none)"})
 	} else {
 		commentRowLabel := "Comment"
-		for _, v := range comments {
-			data = append(data, []string{commentRowLabel, v.CommentText})
+		for i := range threaded {
+			indent := strings.Repeat("  ", threaded[i].depth)
+			text := renderMarkdown(threaded[i].CommentText, textWidth-len(indent), useColor)
+			data = append(data, []string{commentRowLabel, ac.commentHeading(&threaded[i])})
+			data = append(data, []string{"", indent + strings.Replace(text, "\n", "\n"+indent, -1)})
 			commentRowLabel = ""
 		}
 	}
 
+	// Most exceptions won't have any of these, so don't clutter things up with a "(none)"
+	var auditEntries []AuditEntry
+	err = db.Model(exception).Related(&auditEntries).Error
+	if err != nil {
+		return dbError(err)
+	}
+	auditRowLabel := "Audit"
+	for _, v := range auditEntries {
+		data = append(data, []string{auditRowLabel, wrapText(fmt.Sprintf("%s: %s, by %s [%s]", v.Action, v.Detail, v.Actor, v.CreatedAt.Format("2006-01-02")), textWidth)})
+		auditRowLabel = ""
+	}
+
 	table.AppendBulk(data)
 	table.Render()
+	return nil
 }
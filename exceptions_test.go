@@ -0,0 +1,164 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2026, time.June, 15, 12, 0, 0, 0, time.UTC)
+
+// One exception in each state list and report know about, the same as the
+// ones test.sh uses, and one on the last day before it's overdue:
+//  1. undecided, on grace
+//  2. approved, not started yet
+//  3. implemented, should have been removed already
+//  4. implemented, ends within five days
+//  5. implemented, ends within two weeks
+//  6. rejected
+//  7. removed
+//  8. undecided, ending before it starts
+//  9. implemented, ends today
+func seedListExceptions(t *testing.T, ac *appContext) {
+	t.Helper()
+	day := func(days int) string {
+		return ac.today().AddDate(0, 0, days).Format(dateLayout)
+	}
+	exceptions := []struct {
+		starts, ends string
+		service      string
+		statuses     []func(*appContext, uint, bool) error
+	}{
+		{"today", "", "grace", nil},
+		{day(10), day(100), "myriad", []func(*appContext, uint, bool) error{approve}},
+		{day(-100), day(-1), "myriad", []func(*appContext, uint, bool) error{approve, implement}},
+		{day(-100), day(3), "myriad", []func(*appContext, uint, bool) error{approve, implement}},
+		{day(-100), day(10), "myriad", []func(*appContext, uint, bool) error{approve, implement}},
+		{"today", "", "myriad", []func(*appContext, uint, bool) error{reject}},
+		{day(-100), day(-50), "myriad", []func(*appContext, uint, bool) error{approve, implement, remove}},
+		{day(10), day(-10), "myriad", nil},
+		{day(-100), "today", "myriad", []func(*appContext, uint, bool) error{approve, implement}},
+	}
+	for i, v := range exceptions {
+		id, err := submitWithAllParts(ac, "aaaaaa"+strconv.Itoa(i+1), "today", v.starts, v.ends, v.service, "quota", "5TB Scratch", true, true)
+		if err != nil {
+			t.Fatalf("submitting exception %d: %s", i+1, err)
+		}
+		for _, changeStatus := range v.statuses {
+			err = changeStatus(ac, id, false)
+			if err != nil {
+				t.Fatalf("changing the status of exception %d: %s", id, err)
+			}
+		}
+	}
+}
+
+// The IDs in the first column of a table printed by list.
+func listedIDs(output string) []uint {
+	ids := []uint{}
+	for _, line := range strings.Split(output, "\n") {
+		id, err := strconv.ParseUint(strings.TrimSpace(strings.Split(line, "|")[0]), 10, 0)
+		if err == nil {
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids
+}
+
+func TestListClasses(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	seedListExceptions(t, ac)
+
+	expected := map[string][]uint{
+		"all":          {1, 2, 3, 4, 5, 6, 7, 8, 9},
+		"undecided":    {1, 8},
+		"approved":     {2},
+		"rejected":     {6},
+		"needed":       {2},
+		"pending":      {2},
+		"active":       {3, 4, 5, 9},
+		"implemented":  {3, 4, 5, 9},
+		"removed":      {7},
+		"overdue":      {3},
+		"todo":         {1, 2, 3, 8},
+		"inconsistent": {8},
+		"overlapping":  {},
+	}
+	for _, class := range listOpts {
+		want, ok := expected[class]
+		if !ok {
+			t.Errorf("list %s: no test for this class", class)
+			continue
+		}
+		got := listedIDs(captureStdout(t, func() error { return list(ac, class) }))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("list %s: got %v, want %v", class, got, want)
+		}
+	}
+}
+
+func TestListService(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	seedListExceptions(t, ac)
+
+	*listService = "grace"
+	defer func() { *listService = "" }()
+	got := listedIDs(captureStdout(t, func() error { return list(ac, "all") }))
+	if !reflect.DeepEqual(got, []uint{1}) {
+		t.Errorf("list --service=grace all: got %v, want [1]", got)
+	}
+}
+
+// What's today in the configured zone decides what's overdue, not UTC.
+func TestListOverdueUsesConfiguredTimezone(t *testing.T) {
+	// 00:30 on the 16th in London, but still the 15th in UTC
+	ac := newTestAppContext(t, time.Date(2026, time.June, 15, 23, 30, 0, 0, time.UTC), `"timezone": "Europe/London"`)
+	_, err := submitWithAllParts(ac, "aaaaaa1", "2026-06-01", "2026-06-01", "2026-06-15", "myriad", "quota", "5TB Scratch", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, changeStatus := range []func(*appContext, uint, bool) error{approve, implement} {
+		err = changeStatus(ac, 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := listedIDs(captureStdout(t, func() error { return list(ac, "overdue") }))
+	if !reflect.DeepEqual(got, []uint{1}) {
+		t.Errorf("list overdue: got %v, want [1]", got)
+	}
+}
+
+func TestListDateFilters(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	seedListExceptions(t, ac)
+
+	for _, v := range []struct {
+		flag *string
+		text string
+		want []uint
+	}{
+		{listEndsBefore, "today", []uint{3, 7, 8}},
+		{listEndsBefore, "+5d", []uint{3, 4, 7, 8, 9}},
+		{listEndsAfter, "+5d", []uint{1, 2, 5, 6}},
+		{listStartsAfter, "today", []uint{2, 8}},
+		{listStartsBefore, "2026-06-15", []uint{3, 4, 5, 7, 9}},
+	} {
+		*v.flag = v.text
+		got := listedIDs(captureStdout(t, func() error { return list(ac, "all") }))
+		*v.flag = ""
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("list with %q: got %v, want %v", v.text, got, v.want)
+		}
+	}
+
+	*listEndsBefore = "sometime"
+	defer func() { *listEndsBefore = "" }()
+	err := list(ac, "all")
+	if exitCodeFor(err) != exitValidation {
+		t.Errorf("list --ends-before=sometime: got %v, want a validation error", err)
+	}
+}
@@ -8,8 +8,10 @@ else
   go get github.com/go-sql-driver/mysql
   go get github.com/olekukonko/tablewriter
   go get gopkg.in/alecthomas/kingpin.v2
-  go get gopkg.in/AlecAivazis/survey.v1
+  go get github.com/AlecAivazis/survey/v2
   go get github.com/jinzhu/gorm
   go get github.com/mattn/go-sqlite3
+  go get github.com/lib/pq
+  go get github.com/klauspost/compress/zstd
   go get golang.org/x/crypto/ssh/terminal
 fi
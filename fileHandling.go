@@ -1,146 +1,605 @@
 package main
 
 import (
-	"errors"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"unicode"
 
+	"github.com/jinzhu/gorm"
 	"github.com/olekukonko/tablewriter"
 )
 
-func attach(id uint, filename string) (uint, error) {
-	db := getDB()
-	defer db.Close()
-	exception := &Exception{}
-	db.First(&exception, id)
-	if exception.ID == 0 {
-		fmt.Println("No record of that exception.")
-		return 0, errors.New("No record of that exception.")
+// People tend to re-attach the same form when they're not sure it went in
+// the first time, so unless allowDuplicate is set, attaching a file that's
+// identical to one the exception already has is refused.
+func attach(ac *appContext, id uint, filename string, allowDuplicate bool, description string) (uint, error) {
+	db := ac.db
+	_, err := GetException(db, id)
+	if err != nil {
+		return 0, err
+	}
+
+	// Checked before reading it in, so nobody has to wait for us to read
+	//  a huge file only to be told it's too big
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, validationErrorf("could not read file to attach: %s", err)
+	}
+	if info.Size() > ac.config.maxAttachmentBytes {
+		return 0, validationErrorf("%s is %s, which is more than the limit for attachments of %s (set by max_attachment_size in the config file)",
+			filename, formatSize(info.Size()), formatSize(ac.config.maxAttachmentBytes))
 	}
 
 	basename := filepath.Base(filename)
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
-		panic(err)
+		return 0, validationErrorf("could not read file to attach: %s", err)
 	}
 
 	formFile := &FormFile{}
-	formFile.FileContents = b
 	formFile.FileName = basename
 	formFile.ExceptionID = id
-	db.Save(&formFile)
+	formFile.SHA256 = sha256Hex(b)
+	formFile.Size = int64(len(b))
+	formFile.MIMEType = detectMIMEType(basename, b)
+	formFile.Description = description
+	stored, compression, err := compressForStorage(b, formFile.MIMEType, ac.config.compression)
+	if err != nil {
+		return 0, err
+	}
+	formFile.Compression = compression
+
+	duplicate := &FormFile{}
+	err = db.Select("id, file_name").
+		Where("exception_id = ? AND sha256 = ? AND size = ? AND replaced_by_id IS NULL", id, formFile.SHA256, formFile.Size).
+		First(duplicate).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return 0, dbError(err)
+	}
+	if err == nil {
+		if !allowDuplicate {
+			return 0, validationErrorf("exception %d already has an identical file attached (file %d, %s): use --allow-duplicate to attach it again anyway", id, duplicate.ID, duplicate.FileName)
+		}
+		log.Printf("Warning: exception %d already has an identical file attached (file %d, %s).", id, duplicate.ID, duplicate.FileName)
+	}
+
+	store, err := ac.defaultStore()
+	if err != nil {
+		return 0, err
+	}
+	err = store.Put(formFile, stored)
+	if err != nil {
+		return 0, fmt.Errorf("could not store file: %s", err)
+	}
+
+	err = db.Save(formFile).Error
+	if err != nil {
+		return 0, dbError(err)
+	}
 	return formFile.ID, nil
 }
 
-func getFilesForException(id uint) ([]FormFile, error) {
-	db := getDB()
-	defer db.Close()
-	exception := &Exception{}
-	db.First(&exception, id)
-	if exception.ID == 0 {
-		return nil, errors.New("No record of that exception.")
+// Goes by the contents first, but they can only tell us so much: Word
+// documents, for example, just look like zip files, so if the extension
+// says something more specific, that wins.
+func detectMIMEType(filename string, contents []byte) string {
+	detected := http.DetectContentType(contents)
+	if detected == "application/octet-stream" || detected == "application/zip" {
+		byExtension := mime.TypeByExtension(filepath.Ext(filename))
+		if byExtension != "" {
+			return byExtension
+		}
 	}
+	return detected
+}
 
-	formFiles := &[]FormFile{}
-	db.Model(&exception).Related(&formFiles)
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// Only the current version of each file, unless withHistory is set.
+func getFilesForException(db *gorm.DB, id uint, withHistory bool) ([]FormFile, error) {
+	exception, err := GetException(db, id)
+	if err != nil {
+		return nil, err
+	}
 
-	return *formFiles, nil
+	query := db.Model(exception)
+	if !withHistory {
+		query = query.Where("replaced_by_id IS NULL")
+	}
+	formFiles := []FormFile{}
+	err = query.Related(&formFiles).Error
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	return formFiles, nil
 }
 
-func listFilesForException(id uint) {
-	files, err := getFilesForException(id)
+func listFilesForException(ac *appContext, id uint, withHistory bool) error {
+	files, err := getFilesForException(ac.db, id, withHistory)
 
 	if err != nil {
-		fmt.Printf("Could not get files for exception %d: %s\n", id, err)
-		return
+		return fmt.Errorf("could not get files for exception %d: %w", id, err)
 	}
 
 	if len(files) == 0 {
 		fmt.Printf("No files for exception %d.\n", id)
-		return
+		return nil
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"ID", "Created On", "Filename", "Size"})
+	header := []string{"ID", "Created On", "Filename", "Description", "Type", "Size", "Stored As", "SHA-256"}
+	if withHistory {
+		header = append(header, "Replaced By")
+	}
+	table.SetHeader(header)
 	table.SetBorder(false)
 
 	for _, file := range files {
-		table.Append([]string{fmt.Sprintf("%d", file.ID),
+		storedAs := file.Storage
+		if storedAs == "" {
+			storedAs = storageDatabase
+		}
+		if file.Compression != compressionNone {
+			storedAs += ", " + file.Compression
+		}
+		row := []string{fmt.Sprintf("%d", file.ID),
 			stringFromDate(&file.CreatedAt),
 			file.FileName,
-			fmt.Sprintf("%d", len(file.FileContents)),
-		})
+			file.Description,
+			file.MIMEType,
+			fmt.Sprintf("%d", file.Size),
+			storedAs,
+			file.SHA256,
+		}
+		if withHistory {
+			replacedBy := ""
+			if file.ReplacedByID != nil {
+				replacedBy = fmt.Sprint(*file.ReplacedByID)
+			}
+			row = append(row, replacedBy)
+		}
+		table.Append(row)
 	}
 	table.Render()
-	return
+	return nil
+}
+
+func getFile(db *gorm.DB, fileID uint) (*FormFile, error) {
+	file := &FormFile{}
+	err := db.First(file, fileID).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, notFoundErrorf("no record of file %d", fileID)
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return file, nil
+}
+
+// Soft-deletes a file, so it's gone from everywhere but can be got back from
+// the database if it was a mistake, and records who did it.
+func removeFile(ac *appContext, fileID uint) error {
+	file, err := getFile(ac.db, fileID)
+	if err != nil {
+		return err
+	}
+	err = ac.db.Delete(file).Error
+	if err != nil {
+		return dbError(err)
+	}
+	return recordAudit(ac.db, file.ExceptionID, "remove file", fmt.Sprintf("removed file %d (%s)", file.ID, file.FileName))
+}
+
+// Attaches a new version of a file. The old version is kept, and can still be
+// seen with `form list --history` and downloaded by ID. Unless a new
+// description is given, the new version keeps the old one's.
+func replaceFile(ac *appContext, fileID uint, filename string, description string) (uint, error) {
+	old, err := getFile(ac.db, fileID)
+	if err != nil {
+		return 0, err
+	}
+	if old.ReplacedByID != nil {
+		return 0, validationErrorf("file %d has already been replaced by file %d: replace that one instead", old.ID, *old.ReplacedByID)
+	}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, validationErrorf("could not read file to attach: %s", err)
+	}
+	if sha256Hex(contents) == old.SHA256 {
+		return 0, validationErrorf("file %d already has exactly these contents", old.ID)
+	}
+	if description == "" {
+		description = old.Description
+	}
+
+	newID, err := attach(ac, old.ExceptionID, filename, false, description)
+	if err != nil {
+		return 0, err
+	}
+	err = ac.db.Model(old).UpdateColumn("replaced_by_id", newID).Error
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return newID, recordAudit(ac.db, old.ExceptionID, "replace file", fmt.Sprintf("replaced file %d (%s) with file %d (%s)", old.ID, old.FileName, newID, filepath.Base(filename)))
+}
+
+// How and where downloaded files get written out.
+type downloadOptions struct {
+	outputDir string // Must already exist
+	overwrite bool   // Otherwise clashing names get " (1)" etc added
+	stdout    bool   // Only for single files: outputDir and overwrite don't apply
+	zip       bool   // Only for download-for: one zip file for the lot
 }
 
 // This is for when you want to download a single file and have
 //  referred to it directly by ID
-func downloadOneFile(fileID uint) {
-	db := getDB()
-	defer db.Close()
-	file := &FormFile{}
-	db.First(&file, fileID)
-	if file.ID == 0 {
-		fmt.Println("No record of that file.")
-		return
+func downloadOneFile(ac *appContext, fileID uint, options downloadOptions) error {
+	file, err := getFile(ac.db, fileID)
+	if err != nil {
+		return err
+	}
+
+	contents, err := verifiedContents(ac, file)
+	if err != nil {
+		return err
 	}
 
-	targetFilename := file.FileName
-	// This is a while loop in any other language
-	for fileExists(targetFilename) {
-		targetFilename += "_"
+	if options.stdout {
+		_, err = os.Stdout.Write(contents)
+		return err
 	}
-	err := writeOutFile(*file, targetFilename)
+
+	err = checkOutputDir(options.outputDir)
 	if err != nil {
-		fmt.Println("Could not write out file to ", targetFilename, ": ", err)
-		return
+		return err
+	}
+	targetFilename, err := writeOutFile(contents, options.outputDir, safeFilename(file.FileName, file.ID), options.overwrite)
+	if err != nil {
+		return err
 	}
 	fmt.Printf("Wrote out file %d to: %s\n", fileID, targetFilename)
-	return
+	return nil
 }
 
 // This is for when you want all the files for an exception and
 //  have referred to the *exception* by ID, not the file
-func downloadFilesForException(exceptionID uint) {
-	files, err := getFilesForException(exceptionID)
+func downloadFilesForException(ac *appContext, exceptionID uint, options downloadOptions) error {
+	files, err := getFilesForException(ac.db, exceptionID, false)
+	if err != nil {
+		return err
+	}
+	err = checkOutputDir(options.outputDir)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
 
-	for _, file := range files {
-		targetFilename := file.FileName
-		// This is a while loop in any other language
-		for fileExists(targetFilename) {
-			targetFilename += "_"
+	// All of them get checked first, so we either write out all the files
+	//  or none of them
+	contents := make([][]byte, len(files))
+	for i := range files {
+		contents[i], err = verifiedContents(ac, &files[i])
+		if err != nil {
+			return err
 		}
-		err := writeOutFile(file, targetFilename)
+	}
+
+	if options.zip {
+		targetFilename, err := writeOutZip(files, contents, options.outputDir, fmt.Sprintf("exception-%d.zip", exceptionID), options.overwrite)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote out %d files to: %s\n", len(files), targetFilename)
+		return nil
+	}
+
+	for i, file := range files {
+		targetFilename, err := writeOutFile(contents[i], options.outputDir, safeFilename(file.FileName, file.ID), options.overwrite)
 		if err != nil {
-			fmt.Println("Could not write out file to ", targetFilename, ": ", err)
-			return
+			return err
 		}
 		fmt.Printf("Wrote out file %d to: %s\n", file.ID, targetFilename)
 	}
-	return
+	return nil
+}
+
+func checkOutputDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return validationErrorf("could not use output directory: %s", err)
+	}
+	if !info.IsDir() {
+		return validationErrorf("could not use output directory: %s is not a directory", dir)
+	}
+	return nil
 }
 
-func fileExists(filename string) bool {
-	// For checking you're not overwriting a file first
-	_, err := os.Stat(filename)
+// Filenames come from whoever attached the file, so they could be anything:
+// this makes sure one can only ever name a plain file inside the output
+// directory. Anything that leaves nothing usable gets a name from the ID.
+func safeFilename(filename string, fileID uint) string {
+	safe := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, filename)
+	// No hidden files, and no "." or ".."
+	safe = strings.TrimLeft(strings.TrimSpace(safe), ".")
+	if safe == "" {
+		return fmt.Sprintf("file-%d", fileID)
+	}
+	return safe
+}
+
+// Names to try, in order, for a file called filename: the name itself, then
+// "name (1).ext", "name (2).ext" and so on.
+func candidateFilename(filename string, attempt int) string {
+	if attempt == 0 {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	if ext == filename {
+		ext = ""
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filename, ext), attempt, ext)
+}
+
+// Creates a new file in dir, called filename or, if that's taken and we're
+// not overwriting, the first free candidateFilename. Creating it with
+// O_EXCL means we can never clobber something that appeared in the meantime.
+func createOutputFile(dir string, filename string, overwrite bool) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	for attempt := 0; ; attempt++ {
+		target := filepath.Join(dir, candidateFilename(filename, attempt))
+		outFile, err := os.OpenFile(target, flags, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not write out file to %s: %s", target, err)
+		}
+		return outFile, nil
+	}
+}
+
+// Only readable by you, since these are people's forms, and returns the
+// name it actually used.
+func writeOutFile(contents []byte, dir string, filename string, overwrite bool) (string, error) {
+	outFile, err := createOutputFile(dir, filename, overwrite)
+	if err != nil {
+		return "", err
+	}
+	_, err = outFile.Write(contents)
+	closeErr := outFile.Close()
 	if err == nil {
-		return true
+		err = closeErr
 	}
-	if os.IsNotExist(err) {
-		return false
+	if err != nil {
+		os.Remove(outFile.Name())
+		return "", fmt.Errorf("could not write out file to %s: %s", outFile.Name(), err)
 	}
-	panic(err)
+	return outFile.Name(), nil
 }
 
-func writeOutFile(file FormFile, targetFilename string) error {
-	//ioutil.WriteFile(filename string, data []byte, perm os.FileMode) error
-	return ioutil.WriteFile(targetFilename, file.FileContents, os.FileMode(0500))
+// Files inside the zip are named the same way as they would be on disk,
+// clashes and all.
+func writeOutZip(files []FormFile, contents [][]byte, dir string, filename string, overwrite bool) (string, error) {
+	outFile, err := createOutputFile(dir, filename, overwrite)
+	if err != nil {
+		return "", err
+	}
+
+	zipWriter := zip.NewWriter(outFile)
+	used := make(map[string]bool)
+	for i, file := range files {
+		attempt := 0
+		for used[candidateFilename(safeFilename(file.FileName, file.ID), attempt)] {
+			attempt++
+		}
+		name := candidateFilename(safeFilename(file.FileName, file.ID), attempt)
+		used[name] = true
+
+		var entry io.Writer
+		entry, err = zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: file.CreatedAt})
+		if err != nil {
+			break
+		}
+		_, err = entry.Write(contents[i])
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = zipWriter.Close()
+	}
+	closeErr := outFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outFile.Name())
+		return "", fmt.Errorf("could not write out zip file to %s: %s", outFile.Name(), err)
+	}
+	return outFile.Name(), nil
+}
+
+func sha256Hex(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// What's wrong with a stored file, or "" if nothing is.
+func verifyFile(ac *appContext, file *FormFile) string {
+	_, problem := checkContents(ac, file)
+	return problem
+}
+
+// Files attached before checksums were recorded have none until upgradedb
+// has been run, so there's nothing to check them against: they count as
+// fine here, and it's up to the callers to warn about them (see
+// noChecksumWarning).
+func checkContents(ac *appContext, file *FormFile) ([]byte, string) {
+	contents, err := ac.fileContents(file)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if file.SHA256 == "" {
+		return contents, ""
+	}
+	if int64(len(contents)) != file.Size {
+		return nil, fmt.Sprintf("size is %d, should be %d", len(contents), file.Size)
+	}
+	if sha256Hex(contents) != file.SHA256 {
+		return nil, "contents do not match checksum"
+	}
+	return contents, ""
+}
+
+const noChecksumWarning = "no checksum recorded, so it could not be checked (run upgradedb to record one)"
+
+// Decompresses and checks a file, for writing it out.
+func verifiedContents(ac *appContext, file *FormFile) ([]byte, error) {
+	contents, problem := checkContents(ac, file)
+	if problem != "" {
+		return nil, classify(exitInconsistent, fmt.Errorf("not writing out file %d (%s): %s", file.ID, file.FileName, problem))
+	}
+	if file.SHA256 == "" {
+		log.Printf("Warning: file %d (%s) has %s.", file.ID, file.FileName, noChecksumWarning)
+	}
+	return contents, nil
+}
+
+// Checks the stored contents of every file attached to an exception, or of
+// every file in the database if exceptionID is 0, against their checksums.
+// Files are loaded one at a time, so checking everything doesn't mean
+// having everything in memory at once.
+func verifyFiles(ac *appContext, exceptionID uint) error {
+	query := ac.db.Model(&FormFile{})
+	if exceptionID != 0 {
+		_, err := GetException(ac.db, exceptionID)
+		if err != nil {
+			return err
+		}
+		query = query.Where("exception_id = ?", exceptionID)
+	}
+
+	var fileIDs []uint
+	err := query.Order("id").Pluck("id", &fileIDs).Error
+	if err != nil {
+		return dbError(err)
+	}
+	if len(fileIDs) == 0 {
+		fmt.Println("No files to check.")
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"ID", "Exception", "Filename", "Size", "Result"})
+	table.SetBorder(false)
+	table.SetAutoWrapText(false)
+
+	bad := 0
+	for _, id := range fileIDs {
+		file := &FormFile{}
+		err = ac.db.First(file, id).Error
+		if err != nil {
+			return dbError(err)
+		}
+		result := verifyFile(ac, file)
+		switch {
+		case result != "":
+			bad++
+		case file.SHA256 == "":
+			result = noChecksumWarning
+		default:
+			result = "ok"
+		}
+		table.Append([]string{fmt.Sprint(file.ID), fmt.Sprint(file.ExceptionID), file.FileName, fmt.Sprint(file.Size), result})
+	}
+	table.Render()
+
+	if bad != 0 {
+		return classify(exitInconsistent, fmt.Errorf("%d of %d files failed verification", bad, len(fileIDs)))
+	}
+	return nil
+}
+
+// Files attached before the SHA256, Size and MIMEType columns were added
+// have none of them, so upgradedb fills them in from the contents as they are
+// now. Ones that are already filled in are left alone: recalculating the
+// checksum would hide any damage done since it was recorded.
+func backfillFileDetails(ac *appContext) error {
+	db := ac.db
+	// Everything attached before there was a choice of stores is in the
+	//  database
+	err := db.Unscoped().Model(&FormFile{}).Where("storage IS NULL OR storage = ''").
+		UpdateColumn("storage", storageDatabase).Error
+	if err != nil {
+		return dbError(err)
+	}
+
+	// Soft-deleted files too, since backups have them in
+	var fileIDs []uint
+	err = db.Unscoped().Model(&FormFile{}).
+		Where("sha256 IS NULL OR sha256 = '' OR mime_type IS NULL OR mime_type = ''").
+		Pluck("id", &fileIDs).Error
+	if err != nil {
+		return dbError(err)
+	}
+
+	for _, id := range fileIDs {
+		file := &FormFile{}
+		err = db.Unscoped().First(file, id).Error
+		if err != nil {
+			return dbError(err)
+		}
+		contents, err := ac.fileContents(file)
+		if err != nil {
+			return err
+		}
+
+		updates := make(map[string]interface{})
+		if file.SHA256 == "" {
+			updates["sha256"] = sha256Hex(contents)
+			updates["size"] = len(contents)
+		}
+		if file.MIMEType == "" {
+			updates["mime_type"] = detectMIMEType(file.FileName, contents)
+		}
+		err = db.Unscoped().Model(file).UpdateColumns(updates).Error
+		if err != nil {
+			return dbError(err)
+		}
+	}
+	if len(fileIDs) != 0 {
+		log.Printf("Filled in checksums and types for %d existing files.", len(fileIDs))
+	}
+	return nil
 }
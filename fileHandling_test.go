@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A file as it was attached before checksums, sizes, MIME types and stores
+// were recorded, and before upgradedb has been run to fill them in.
+func attachOldStyleFile(t *testing.T, ac *appContext, contents string) *FormFile {
+	t.Helper()
+	_, err := submitWithAllParts(ac, "aaaaaa1", "today", "today", "", "myriad", "quota", "5TB Scratch", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &FormFile{ExceptionID: 1, FileName: "old_form.txt", FileContents: []byte(contents)}
+	err = ac.db.Create(file).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestFilesWithoutChecksumsCanStillBeDownloaded(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	file := attachOldStyleFile(t, ac, "An old form")
+
+	contents, err := verifiedContents(ac, file)
+	if err != nil {
+		t.Fatalf("verifiedContents of a file with no checksum: %s", err)
+	}
+	if string(contents) != "An old form" {
+		t.Errorf("verifiedContents of a file with no checksum: got %q", contents)
+	}
+}
+
+func TestVerifyingFilesWithoutChecksums(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	attachOldStyleFile(t, ac, "An old form")
+
+	output := captureStdout(t, func() error { return verifyFiles(ac, 0) })
+	if !strings.Contains(output, "no checksum recorded") {
+		t.Errorf("form verify should say the file has no checksum, but printed:\n%s", output)
+	}
+
+	err := upgradeDB(ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output = captureStdout(t, func() error { return verifyFiles(ac, 0) })
+	if !strings.Contains(output, "| ok") {
+		t.Errorf("form verify should pass the file once upgradedb has recorded its checksum, but printed:\n%s", output)
+	}
+}
+
+func TestFilesThatDontMatchTheirChecksumsAreRefused(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	file := attachOldStyleFile(t, ac, "An old form")
+	err := upgradeDB(ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ac.db.Model(file).UpdateColumn("file_contents", []byte("A changed form")).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ac.db.First(file, file.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifiedContents(ac, file)
+	if exitCodeFor(err) != exitInconsistent {
+		t.Errorf("verifiedContents of a damaged file: got %v, want a damaged file error", err)
+	}
+}
+
+// Backups have soft-deleted files in, so upgradedb has to fill in their
+// checksums too, or the backup can't be restored.
+func TestBackfillIncludesRemovedFiles(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	attachOldStyleFile(t, ac, "An old form")
+	removed := &FormFile{ExceptionID: 1, FileName: "another_old_form.txt", FileContents: []byte("Another old form")}
+	err := ac.db.Create(removed).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = removeFile(ac, removed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = upgradeDB(ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ac.db.Unscoped().First(removed, removed.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed.SHA256 != sha256Hex([]byte("Another old form")) {
+		t.Errorf("upgradedb should have filled in the removed file's checksum, but it's %q", removed.SHA256)
+	}
+
+	backupFilename := filepath.Join(t.TempDir(), "backup.tar.gz")
+	err = backup(ac, backupFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredTo := newTestAppContext(t, testNow)
+	err = restore(restoredTo, backupFilename)
+	if err != nil {
+		t.Fatalf("restoring a backup with a removed file in: %s", err)
+	}
+}
+
+func TestBackupOfFilesWithoutChecksumsVerifiesAndRestores(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	attachOldStyleFile(t, ac, "An old form")
+
+	backupFilename := filepath.Join(t.TempDir(), "backup.tar.gz")
+	err := backup(ac, backupFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := captureStdout(t, func() error { return verifyBackup(backupFilename) })
+	if !strings.Contains(output, "file 1 (old_form.txt) has "+noChecksumWarning) {
+		t.Errorf("verify should point out the file with no checksum, but said:\n%s", output)
+	}
+
+	restoredTo := newTestAppContext(t, testNow)
+	err = restore(restoredTo, backupFilename)
+	if err != nil {
+		t.Fatalf("restoring a backup with a file with no checksum: %s", err)
+	}
+	file := &FormFile{}
+	err = restoredTo.db.First(file, 1).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := verifiedContents(restoredTo, file)
+	if err != nil || string(contents) != "An old form" {
+		t.Errorf("restored file with no checksum: got %q, %v", contents, err)
+	}
+}
+
+func TestFilesOmittedFromDumpsIncludeRemovedAndUnchecksummedOnes(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	attachOldStyleFile(t, ac, "An old form")
+	removed := &FormFile{ExceptionID: 1, FileName: "another_old_form.txt", FileContents: []byte("Another old form")}
+	err := ac.db.Create(removed).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = removeFile(ac, removed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	_, _, err = writeDump(ac, &dump, true, "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := newDumpReader(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exception, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fillOmittedFiles(ac, exception)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exception.FormFiles) != 2 {
+		t.Fatalf("fillOmittedFiles kept %d of the 2 files with no checksum, one of them removed", len(exception.FormFiles))
+	}
+	for _, file := range exception.FormFiles {
+		contents, err := verifiedContents(ac, &file)
+		if err != nil || file.Size != int64(len(contents)) {
+			t.Errorf("file %d after fillOmittedFiles: got %d bytes, size %d, %v", file.ID, len(contents), file.Size, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/olekukonko/tablewriter"
+)
+
+// Things fsck can find. Errors are things that are actually wrong and make
+// fsck exit non-zero if they're left unfixed; warnings are things that are
+// odd but can happen legitimately (e.g. someone used --force), or that
+// need a person to decide what the right answer is.
+type fsckProblem struct {
+	ExceptionID uint
+	Severity    string
+	Problem     string
+	Repair      string
+}
+
+const (
+	fsckError   = "error"
+	fsckWarning = "warning"
+)
+
+// Checks the database for:
+//   - exceptions whose Status disagrees with their StatusChange history
+//   - status histories that don't chain together or that skip around the
+//     state machine in isValidChange
+//   - comments, files and status changes belonging to exceptions that don't exist
+//   - dates that don't make sense
+//
+// If fix is set, the status mismatches and orphans are repaired, each repair
+// getting an AuditEntry. trust says which side of a mismatch is right:
+// "history" sets Status from the last StatusChange, "status" adds a
+// StatusChange to bring the history up to Status.
+func fsck(ac *appContext, fix bool, trust string) error {
+	var problems []fsckProblem
+
+	var exceptions []Exception
+	err := ac.db.Preload("StatusChanges").Order("id").Find(&exceptions).Error
+	if err != nil {
+		return dbError(err)
+	}
+
+	today := ac.today()
+	for i := range exceptions {
+		exception := &exceptions[i]
+		problems = append(problems, checkStatusHistory(exception)...)
+		problems = append(problems, checkDates(exception, today)...)
+
+		trackedStatus := trackedStatusFrom(exception.StatusChanges)
+		if trackedStatus != exception.GetStatus() {
+			problem := fsckProblem{
+				ExceptionID: exception.ID,
+				Severity:    fsckError,
+				Problem:     fmt.Sprintf("status is %s but status history says %s", exception.GetStatus(), trackedStatus),
+			}
+			if fix {
+				problem.Repair, err = repairStatus(ac.db, exception, trackedStatus, trust)
+				if err != nil {
+					return err
+				}
+			}
+			problems = append(problems, problem)
+		}
+	}
+
+	orphanProblems, err := checkOrphans(ac.db, fix)
+	if err != nil {
+		return err
+	}
+	problems = append(problems, orphanProblems...)
+
+	if len(problems) == 0 {
+		fmt.Println("No problems found.")
+		return nil
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].ExceptionID < problems[j].ExceptionID })
+
+	unfixed := 0
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Exception", "Severity", "Problem", "Repair"})
+	table.SetBorder(false)
+	table.SetAutoWrapText(false)
+	for _, problem := range problems {
+		repair := problem.Repair
+		if repair == "" {
+			repair = "--"
+			if problem.Severity == fsckError {
+				unfixed++
+			}
+		}
+		table.Append([]string{fmt.Sprint(problem.ExceptionID), problem.Severity, problem.Problem, repair})
+	}
+	table.Render()
+
+	if unfixed != 0 {
+		return classify(exitInconsistent, fmt.Errorf("%d error(s) found and not repaired (try --fix)", unfixed))
+	}
+	return nil
+}
+
+func checkStatusHistory(exception *Exception) []fsckProblem {
+	var problems []fsckProblem
+
+	statusChanges := make([]StatusChange, len(exception.StatusChanges))
+	copy(statusChanges, exception.StatusChanges)
+	sort.Slice(statusChanges, func(i, j int) bool { return statusChanges[i].ID < statusChanges[j].ID })
+
+	previousStatus := "(none)"
+	for _, v := range statusChanges {
+		if v.OldStatus != previousStatus {
+			problems = append(problems, fsckProblem{
+				ExceptionID: exception.ID,
+				Severity:    fsckWarning,
+				Problem:     fmt.Sprintf("status change %d is from %s, but the one before left it %s", v.ID, v.OldStatus, previousStatus),
+			})
+		}
+		if !isValidChange(v.OldStatus, v.NewStatus) {
+			problems = append(problems, fsckProblem{
+				ExceptionID: exception.ID,
+				Severity:    fsckWarning,
+				Problem:     fmt.Sprintf("status change %d (%s -> %s, by %s) is not a normal transition", v.ID, v.OldStatus, v.NewStatus, v.Changer),
+			})
+		}
+		previousStatus = v.NewStatus
+	}
+	return problems
+}
+
+func checkDates(exception *Exception, today time.Time) []fsckProblem {
+	var anomalies []string
+
+	if exception.SubmittedDate == nil {
+		anomalies = append(anomalies, "has no submitted date")
+	} else if exception.SubmittedDate.After(today) {
+		anomalies = append(anomalies, "was submitted in the future ("+stringFromDate(exception.SubmittedDate)+")")
+	}
+	if exception.StartDate == nil && exception.EndDate != nil {
+		anomalies = append(anomalies, "has an end date but no start date")
+	}
+	if exception.StartDate != nil && exception.EndDate != nil && exception.StartDate.After(*exception.EndDate) {
+		anomalies = append(anomalies, "starts ("+stringFromDate(exception.StartDate)+") after it ends ("+stringFromDate(exception.EndDate)+")")
+	}
+
+	problems := make([]fsckProblem, 0, len(anomalies))
+	for _, v := range anomalies {
+		problems = append(problems, fsckProblem{ExceptionID: exception.ID, Severity: fsckWarning, Problem: v})
+	}
+	return problems
+}
+
+func repairStatus(db *gorm.DB, exception *Exception, trackedStatus string, trust string) (string, error) {
+	var repair string
+	switch trust {
+	case "history":
+		repair = fmt.Sprintf("set status to %s from history", trackedStatus)
+		err := db.Model(exception).Update("status", trackedStatus).Error
+		if err != nil {
+			return "", dbError(err)
+		}
+	case "status":
+		repair = fmt.Sprintf("added status change %s -> %s to history", trackedStatus, exception.GetStatus())
+		username, err := currentUsername()
+		if err != nil {
+			return "", err
+		}
+		statusChange := &StatusChange{
+			ExceptionID: exception.ID,
+			OldStatus:   trackedStatus,
+			NewStatus:   exception.GetStatus(),
+			Changer:     username,
+		}
+		err = db.Create(statusChange).Error
+		if err != nil {
+			return "", dbError(err)
+		}
+	default:
+		return "", usageErrorf("unknown source of truth for status: %q", trust)
+	}
+
+	return repair, recordAudit(db, exception.ID, "fsck", repair)
+}
+
+// Finds comments, files and status changes that point at exceptions that
+// aren't there at all (as opposed to soft-deleted ones, which are fine).
+// Repairing these soft-deletes them, so nothing is actually lost.
+func checkOrphans(db *gorm.DB, fix bool) ([]fsckProblem, error) {
+	var problems []fsckProblem
+
+	existingIDs := db.Unscoped().Model(&Exception{}).Select("id").QueryExpr()
+
+	for _, kind := range []struct {
+		name  string
+		model interface{}
+	}{
+		{"comment", &Comment{}},
+		{"file", &FormFile{}},
+		{"status change", &StatusChange{}},
+	} {
+		var orphans []struct {
+			ID          uint
+			ExceptionID uint
+		}
+		err := db.Model(kind.model).
+			Select("id, exception_id").
+			Where("exception_id NOT IN (?)", existingIDs).
+			Order("id").
+			Scan(&orphans).Error
+		if err != nil {
+			return nil, dbError(err)
+		}
+
+		for _, orphan := range orphans {
+			problem := fsckProblem{
+				ExceptionID: orphan.ExceptionID,
+				Severity:    fsckError,
+				Problem:     fmt.Sprintf("%s %d belongs to an exception that does not exist", kind.name, orphan.ID),
+			}
+			if fix {
+				err = db.Where("id = ?", orphan.ID).Delete(kind.model).Error
+				if err != nil {
+					return nil, dbError(err)
+				}
+				problem.Repair = fmt.Sprintf("soft-deleted %s %d", kind.name, orphan.ID)
+				err = recordAudit(db, orphan.ExceptionID, "fsck", problem.Repair)
+				if err != nil {
+					return nil, err
+				}
+			}
+			problems = append(problems, problem)
+		}
+	}
+	return problems, nil
+}
@@ -5,39 +5,50 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 )
 
-func getTextFromEditor() (string, error) {
-	tmpfile, err := ioutil.TempFile("", "tmp.*")
-	if err != nil {
-		return "", err
-	}
+// Returned (as a validation error) when the editor is closed without
+// anything new in it, which is how you back out of writing a comment.
+var errNothingWritten = errors.New("nothing was written in the editor, so nothing was changed")
 
-	editor := os.Getenv("EDITOR")
-	if editor == "" {
-		editor = findEditor("vim")
+// Opens an editor on initialText (which can be empty), followed by the
+// lines in about as comments, to say what the text is for, and returns
+// what was saved without them. Like git, lines starting with the comment
+// character are left out, and if initialText has lines that start with #
+// (like Markdown headings), a different character is used instead.
+func getTextFromEditor(initialText string, about []string) (string, error) {
+	commentChar := pickCommentChar(initialText)
+	template := initialText
+	if template != "" && !strings.HasSuffix(template, "\n") {
+		template += "\n"
 	}
-
-	if editor == "" {
-		editor = findEditor("nano")
+	template += "\n" + commentChar + " Lines starting with '" + commentChar + "' are left out. Leave this empty, or unchanged, to give up.\n"
+	if len(about) > 0 {
+		template += commentChar + "\n"
+		for _, line := range about {
+			template += strings.TrimRight(commentChar+" "+line, " ") + "\n"
+		}
 	}
 
-	if editor == "" {
-		editor = findEditor("pico")
+	// The .md is for any syntax highlighting: comments are rendered as Markdown
+	tmpfile, err := ioutil.TempFile("", "exceptions-*.md")
+	if err != nil {
+		return "", err
 	}
-
-	// Ugh fiiiiine :þ
-	if editor == "" {
-		editor = findEditor("emacs")
+	defer os.Remove(tmpfile.Name()) // clean up
+	_, err = tmpfile.WriteString(template)
+	if err == nil {
+		err = tmpfile.Close()
 	}
-
-	if editor == "" {
-		return "", errors.New("No known editor could be found (including via $EDITOR env variable).")
+	if err != nil {
+		return "", err
 	}
 
-	defer os.Remove(tmpfile.Name()) // clean up
-
-	cmd := exec.Command(editor, tmpfile.Name())
+	cmd, err := editorCommand(tmpfile.Name())
+	if err != nil {
+		return "", err
+	}
 
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -58,7 +69,65 @@ func getTextFromEditor() (string, error) {
 		return "", err
 	}
 
-	return string(fileContents), nil
+	text := stripCommentLines(string(fileContents), commentChar)
+	if text == "" || text == stripCommentLines(initialText, commentChar) {
+		return "", validationError(errNothingWritten)
+	}
+	return text, nil
+}
+
+func pickCommentChar(initialText string) string {
+	for _, c := range []string{"#", ";", "%", "|"} {
+		if !strings.HasPrefix(initialText, c) && !strings.Contains(initialText, "\n"+c) {
+			return c
+		}
+	}
+	return "#"
+}
+
+// Also trims blank lines and trailing spaces from the ends, since editors
+// add them, but leaves any indentation at the start alone.
+func stripCommentLines(text string, commentChar string) string {
+	var kept []string
+	for _, line := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n") {
+		if !strings.HasPrefix(line, commentChar) {
+			kept = append(kept, line)
+		}
+	}
+	stripped := strings.TrimRight(strings.Join(kept, "\n"), " \t\n")
+	return strings.TrimLeft(stripped, "\n")
+}
+
+// $VISUAL or $EDITOR, if either is set, are run by the shell, the way git
+// does it, so that ones with options in, like "code --wait", work.
+// Otherwise it's the first editor we can find.
+func editorCommand(filename string) (*exec.Cmd, error) {
+	for _, variable := range []string{"VISUAL", "EDITOR"} {
+		editor := os.Getenv(variable)
+		if editor != "" {
+			return exec.Command("/bin/sh", "-c", editor+` "$@"`, editor, filename), nil
+		}
+	}
+
+	editor := findEditor("vim")
+
+	if editor == "" {
+		editor = findEditor("nano")
+	}
+
+	if editor == "" {
+		editor = findEditor("pico")
+	}
+
+	// Ugh fiiiiine :þ
+	if editor == "" {
+		editor = findEditor("emacs")
+	}
+
+	if editor == "" {
+		return nil, errors.New("No known editor could be found (including via $VISUAL and $EDITOR env variables).")
+	}
+	return exec.Command(editor, filename), nil
 }
 
 func findEditor(editorName string) string {
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// How importjson treats exceptions whose IDs are already in the database:
+//   - replace:       everything already in the database is removed first
+//   - merge:         the dump's version wins
+//   - append:        IDs in the dump are ignored and everything gets new ones
+//   - skip-existing: the database's version wins
+//
+// Exceptions with new IDs are always created, and ones that are identical to
+// what's already there are always left alone, so importing the same dump
+// twice doesn't change anything the second time.
+//
+// Except with append, comments, files etc keep their IDs from the dump too,
+// so if any of those IDs already belong to a different exception, nothing
+// is imported: see childIDConflicts.
+var importModes = []string{"replace", "merge", "append", "skip-existing"}
+
+// What happened (or, with a dry run, would happen) to each exception
+const (
+	importCreated   = "create"
+	importUpdated   = "update"
+	importUnchanged = "unchanged"
+	importSkipped   = "skip"
+	importConflict  = "conflict"
+)
+
+func importAllAsJson(ac *appContext, input io.Reader, mode string, dryRun bool) error {
+	reader, err := newDumpReader(input)
+	if err != nil {
+		return err
+	}
+
+	if mode == "replace" && reader.header.isPartial() {
+		return usageErrorf("cannot use --mode=replace with a partial dump (one made with --no-files, --since or --ids): everything the dump left out would be lost")
+	}
+
+	// ac.db is a transaction here unless this is a dry run (see runCommand),
+	//  so if any of these fail, none of them get imported
+	db := keepingTimestamps(ac.db)
+
+	// Files from the dump go wherever new files would
+	store, err := ac.defaultStore()
+	if err != nil {
+		return err
+	}
+
+	if mode == "replace" {
+		err = removeEverything(db, dryRun)
+		if err != nil {
+			return err
+		}
+	}
+
+	counts := make(map[string]int)
+	for {
+		exception, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if reader.header.FilesOmitted {
+			err = fillOmittedFiles(ac, exception)
+			if err != nil {
+				return err
+			}
+		}
+
+		action, differences, err := importOne(db, store, exception, mode, dryRun)
+		if err != nil {
+			return err
+		}
+		counts[action]++
+
+		if dryRun {
+			printImportAction(exception, action, differences)
+		} else if action == importSkipped {
+			log.Printf("Skipped exception %d: it differs from the one already in the database", exception.ID)
+		} else if action == importConflict {
+			log.Printf("Cannot import exception %d: %s", exception.ID, strings.Join(differences, ", "))
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("Would create %d, update %d, skip %d and leave %d unchanged.\n",
+			counts[importCreated], counts[importUpdated], counts[importSkipped], counts[importUnchanged])
+	}
+
+	// Returning an error rolls back anything that was imported before the
+	//  conflicts were found
+	if counts[importConflict] != 0 {
+		return validationErrorf("%d exceptions in the dump have comments, files, etc whose IDs already belong to other exceptions, so nothing can be imported: use --mode=append to import them with new IDs",
+			counts[importConflict])
+	}
+
+	if !dryRun {
+		err = syncIDSequences(ac.dialect, db)
+		if err != nil {
+			return err
+		}
+		log.Printf("Imported: created %d, updated %d, skipped %d, left %d unchanged.",
+			counts[importCreated], counts[importUpdated], counts[importSkipped], counts[importUnchanged])
+	}
+	return nil
+}
+
+// Imported rows keep the UpdatedAt they had in the dump. Otherwise gorm
+// stamps everything it saves with the current time, so the database never
+// matches the dump it was imported from, importing the same dump a second
+// time finds every exception it touched "changed" all over again, and a
+// restored backup loses when anything was last changed.
+func keepingTimestamps(db *gorm.DB) *gorm.DB {
+	return db.Set("gorm:update_column", true)
+}
+
+func syncIDSequences(dialect dbDialect, db *gorm.DB) error {
+	for _, model := range allModels {
+		err := dialect.SyncIDSequence(db, db.NewScope(model).TableName())
+		if err != nil {
+			return dbError(err)
+		}
+	}
+	return nil
+}
+
+// Hard-deletes every row in every table, for --mode=replace: soft-deleting
+// would leave the IDs taken, and then the dump's rows couldn't use them.
+func removeEverything(db *gorm.DB, dryRun bool) error {
+	var count int
+	err := db.Unscoped().Model(&Exception{}).Count(&count).Error
+	if err != nil {
+		return dbError(err)
+	}
+
+	if dryRun {
+		fmt.Printf("remove all %d exceptions already in the database\n", count)
+		return nil
+	}
+
+	for _, model := range allModels {
+		err = db.Unscoped().Delete(model).Error
+		if err != nil {
+			return dbError(err)
+		}
+	}
+	log.Printf("Removed all %d exceptions already in the database.", count)
+	return nil
+}
+
+// Works out what to do with one exception from the dump and, unless this is
+// a dry run, does it. Returns the action and, for exceptions that are
+// already in the database, a description of how the two versions differ.
+func importOne(db *gorm.DB, store attachmentStore, exception *Exception, mode string, dryRun bool) (string, []string, error) {
+	// Old versions of files and comments, and replies, point at other
+	//  files and comments by ID, so if the IDs change, those have to follow
+	var dumpFileIDs, dumpCommentIDs []uint
+	if mode == "append" {
+		for _, v := range exception.FormFiles {
+			dumpFileIDs = append(dumpFileIDs, v.ID)
+		}
+		for _, v := range exception.Comments {
+			dumpCommentIDs = append(dumpCommentIDs, v.ID)
+		}
+		clearIDs(exception)
+	}
+
+	var existing *Exception
+	if exception.ID != 0 && mode != "replace" && mode != "append" {
+		// Soft-deleted exceptions count as being there, because their IDs
+		//  are still taken, but soft-deleted comments etc never get dumped,
+		//  so they're left out to match
+		existing = &Exception{}
+		notDeleted := "deleted_at IS NULL"
+		err := db.Unscoped().
+			Preload("Comments", notDeleted).
+			Preload("FormFiles", notDeleted).
+			Preload("StatusChanges", notDeleted).
+			Preload("AuditEntries", notDeleted).
+			First(existing, exception.ID).Error
+		if gorm.IsRecordNotFoundError(err) {
+			existing = nil
+		} else if err != nil {
+			return "", nil, dbError(err)
+		}
+	}
+
+	action := importCreated
+	var differences []string
+	if existing != nil {
+		if exceptionContentHash(existing) == exceptionContentHash(exception) {
+			return importUnchanged, nil, nil
+		}
+		// The hashes also differ when the database just has comments etc
+		//  that the dump doesn't, which importing leaves alone anyway
+		differences = describeExceptionDifferences(existing, exception)
+		if len(differences) == 0 {
+			return importUnchanged, nil, nil
+		}
+		if mode == "skip-existing" {
+			return importSkipped, differences, nil
+		}
+		action = importUpdated
+	}
+
+	// With replace, everything already in the database is gone by now (or
+	//  would be, if this weren't a dry run), and with append, everything
+	//  gets new IDs
+	if mode != "replace" && mode != "append" {
+		conflicts, err := childIDConflicts(db, exception)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(conflicts) != 0 {
+			return importConflict, conflicts, nil
+		}
+	}
+
+	if dryRun {
+		return action, differences, nil
+	}
+
+	// The comments etc are saved separately below rather than letting gorm
+	//  do it, because gorm would look for them without Unscoped and then
+	//  fail trying to create any that had been soft-deleted
+	noAssociations := db.Unscoped().Set("gorm:save_associations", false)
+	var err error
+	if action == importCreated {
+		err = noAssociations.Create(exception).Error
+	} else {
+		err = noAssociations.Save(exception).Error
+	}
+	if err != nil {
+		return "", nil, dbError(fmt.Errorf("could not import exception %d: %s", exception.ID, err))
+	}
+
+	// Files whose contents were in the dump go into the store; ones from
+	//  a --no-files dump have been pointed at where they already are by
+	//  fillOmittedFiles
+	for i := range exception.FormFiles {
+		file := &exception.FormFiles[i]
+		if file.Storage == "" {
+			err = store.Put(file, file.FileContents)
+			if err != nil {
+				return "", nil, fmt.Errorf("could not store file %d of exception %d: %s", file.ID, exception.ID, err)
+			}
+		}
+	}
+
+	for _, child := range childrenOf(exception) {
+		err = db.Unscoped().Save(child).Error
+		if err != nil {
+			return "", nil, dbError(fmt.Errorf("could not import exception %d: %s", exception.ID, err))
+		}
+	}
+
+	if dumpFileIDs != nil {
+		newFileIDs := make(map[uint]uint)
+		for i, v := range exception.FormFiles {
+			newFileIDs[dumpFileIDs[i]] = v.ID
+		}
+		for i := range exception.FormFiles {
+			file := &exception.FormFiles[i]
+			if file.ReplacedByID == nil {
+				continue
+			}
+			newID := newFileIDs[*file.ReplacedByID]
+			file.ReplacedByID = &newID
+			err = db.Model(file).UpdateColumn("replaced_by_id", newID).Error
+			if err != nil {
+				return "", nil, dbError(fmt.Errorf("could not import exception %d: %s", exception.ID, err))
+			}
+		}
+	}
+	if dumpCommentIDs != nil {
+		newCommentIDs := make(map[uint]uint)
+		for i, v := range exception.Comments {
+			newCommentIDs[dumpCommentIDs[i]] = v.ID
+		}
+		for i := range exception.Comments {
+			comment := &exception.Comments[i]
+			for _, v := range []struct {
+				column string
+				id     **uint
+			}{
+				{"parent_id", &comment.ParentID},
+				{"replaced_by_id", &comment.ReplacedByID},
+			} {
+				if *v.id == nil {
+					continue
+				}
+				// A reply to a comment that was deleted before the dump
+				//  was made stops being a reply
+				newID, ok := newCommentIDs[**v.id]
+				var value interface{}
+				if ok {
+					*v.id = &newID
+					value = newID
+				} else {
+					*v.id = nil
+					value = gorm.Expr("NULL")
+				}
+				err = db.Model(comment).UpdateColumn(v.column, value).Error
+				if err != nil {
+					return "", nil, dbError(fmt.Errorf("could not import exception %d: %s", exception.ID, err))
+				}
+			}
+		}
+	}
+	return action, differences, nil
+}
+
+// Saving a comment, file etc whose ID already belongs to a different
+// exception would move it onto this one, and take it away from the other,
+// so those are looked for first. Soft-deleted ones count, since their IDs
+// are still taken. Returns a description of each one found.
+func childIDConflicts(db *gorm.DB, exception *Exception) ([]string, error) {
+	var commentIDs, fileIDs, statusChangeIDs, auditEntryIDs []uint
+	for _, v := range exception.Comments {
+		commentIDs = append(commentIDs, v.ID)
+	}
+	for _, v := range exception.FormFiles {
+		fileIDs = append(fileIDs, v.ID)
+	}
+	for _, v := range exception.StatusChanges {
+		statusChangeIDs = append(statusChangeIDs, v.ID)
+	}
+	for _, v := range exception.AuditEntries {
+		auditEntryIDs = append(auditEntryIDs, v.ID)
+	}
+
+	var conflicts []string
+	for _, v := range []struct {
+		kind  string
+		model interface{}
+		ids   []uint
+	}{
+		{"comment", &Comment{}, commentIDs},
+		{"file", &FormFile{}, fileIDs},
+		{"status change", &StatusChange{}, statusChangeIDs},
+		{"audit entry", &AuditEntry{}, auditEntryIDs},
+	} {
+		if len(v.ids) == 0 {
+			continue
+		}
+		var taken []struct {
+			ID          uint
+			ExceptionID uint
+		}
+		err := db.Unscoped().Model(v.model).
+			Select("id, exception_id").
+			Where("id IN (?) AND exception_id <> ?", v.ids, exception.ID).
+			Order("id").
+			Scan(&taken).Error
+		if err != nil {
+			return nil, dbError(err)
+		}
+		for _, t := range taken {
+			conflicts = append(conflicts, fmt.Sprintf("%s %d already belongs to exception %d", v.kind, t.ID, t.ExceptionID))
+		}
+	}
+	return conflicts, nil
+}
+
+// Dumps made with --no-files only have a checksum for each file, so the
+// contents have to come from the database: files that aren't there, or that
+// are but have different contents, are left out of the import. Removed
+// files are looked for too, since dumps have them in. Files the dump has
+// no checksum for can't be checked, so whatever the database has is used,
+// with a warning.
+func fillOmittedFiles(ac *appContext, exception *Exception) error {
+	var files []FormFile
+	for _, v := range exception.FormFiles {
+		existing := &FormFile{}
+		err := ac.db.Unscoped().First(existing, v.ID).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return dbError(err)
+		}
+		var contents []byte
+		if err == nil {
+			contents, err = ac.fileContents(existing)
+		}
+		if err != nil || (v.SHA256 != "" && sha256Hex(contents) != v.SHA256) {
+			log.Printf("Not importing file %d of exception %d: its contents aren't in the dump, and aren't in the database either", v.ID, exception.ID)
+			continue
+		}
+		if v.SHA256 == "" {
+			log.Printf("Warning: file %d (%s) has %s.", v.ID, v.FileName, noChecksumWarning)
+		}
+		// Left exactly as they are, compressed or not, in whichever store
+		v.FileContents = nil
+		v.Storage = existing.Storage
+		v.StorageKey = existing.StorageKey
+		v.Compression = existing.Compression
+		if existing.Storage == storageDatabase || existing.Storage == "" {
+			v.FileContents = existing.FileContents
+		}
+		v.Size = int64(len(contents))
+		files = append(files, v)
+	}
+	exception.FormFiles = files
+	return nil
+}
+
+// Pointers to all the comments, files etc of an exception, with their
+// ExceptionIDs set to match it.
+func childrenOf(exception *Exception) []interface{} {
+	var children []interface{}
+	for i := range exception.Comments {
+		exception.Comments[i].ExceptionID = exception.ID
+		children = append(children, &exception.Comments[i])
+	}
+	for i := range exception.FormFiles {
+		exception.FormFiles[i].ExceptionID = exception.ID
+		children = append(children, &exception.FormFiles[i])
+	}
+	for i := range exception.StatusChanges {
+		exception.StatusChanges[i].ExceptionID = exception.ID
+		children = append(children, &exception.StatusChanges[i])
+	}
+	for i := range exception.AuditEntries {
+		exception.AuditEntries[i].ExceptionID = exception.ID
+		children = append(children, &exception.AuditEntries[i])
+	}
+	return children
+}
+
+func clearIDs(exception *Exception) {
+	exception.ID = 0
+	for i := range exception.Comments {
+		exception.Comments[i].ID = 0
+	}
+	for i := range exception.FormFiles {
+		exception.FormFiles[i].ID = 0
+	}
+	for i := range exception.StatusChanges {
+		exception.StatusChanges[i].ID = 0
+	}
+	for i := range exception.AuditEntries {
+		exception.AuditEntries[i].ID = 0
+	}
+}
+
+func printImportAction(exception *Exception, action string, differences []string) {
+	switch action {
+	case importUnchanged:
+		return
+	case importCreated:
+		id := fmt.Sprintf("exception %d", exception.ID)
+		if exception.ID == 0 {
+			id = "new exception"
+		}
+		fmt.Printf("create %s (%s, %s %s)\n", id, exception.Username, exception.Service, exception.ExceptionType)
+	case importUpdated:
+		fmt.Printf("update exception %d:\n", exception.ID)
+	case importSkipped:
+		fmt.Printf("skip exception %d, which differs from the database:\n", exception.ID)
+	case importConflict:
+		id := fmt.Sprintf("exception %d", exception.ID)
+		if exception.ID == 0 {
+			id = "new exception"
+		}
+		fmt.Printf("cannot import %s, whose IDs clash with other exceptions':\n", id)
+	}
+	for _, v := range differences {
+		fmt.Printf("    %s\n", v)
+	}
+}
+
+// Databases differ in how precisely they keep times and which zone they
+// hand them back in, so to compare an exception from a dump with one from
+// the database, all the times are put in UTC to the nearest second first.
+// Children are sorted by ID, since the order they load in isn't fixed.
+func normaliseForComparison(exception *Exception) *Exception {
+	n := *exception
+	normaliseModel(&n.Model)
+	n.SubmittedDate = normaliseTime(n.SubmittedDate)
+	n.StartDate = normaliseTime(n.StartDate)
+	n.EndDate = normaliseTime(n.EndDate)
+
+	n.Comments = append([]Comment(nil), exception.Comments...)
+	for i := range n.Comments {
+		normaliseModel(&n.Comments[i].Model)
+	}
+	sort.Slice(n.Comments, func(i, j int) bool { return n.Comments[i].ID < n.Comments[j].ID })
+
+	n.FormFiles = append([]FormFile(nil), exception.FormFiles...)
+	for i := range n.FormFiles {
+		// The contents depend on which store the file is in (and files
+		//  in most of them have none here), so they're compared by
+		//  checksum instead
+		normaliseModel(&n.FormFiles[i].Model)
+		n.FormFiles[i].FileContents = nil
+		n.FormFiles[i].Compression = compressionNone
+	}
+	sort.Slice(n.FormFiles, func(i, j int) bool { return n.FormFiles[i].ID < n.FormFiles[j].ID })
+
+	n.StatusChanges = append([]StatusChange(nil), exception.StatusChanges...)
+	for i := range n.StatusChanges {
+		normaliseModel(&n.StatusChanges[i].Model)
+	}
+	sort.Slice(n.StatusChanges, func(i, j int) bool { return n.StatusChanges[i].ID < n.StatusChanges[j].ID })
+
+	n.AuditEntries = append([]AuditEntry(nil), exception.AuditEntries...)
+	for i := range n.AuditEntries {
+		normaliseModel(&n.AuditEntries[i].Model)
+	}
+	sort.Slice(n.AuditEntries, func(i, j int) bool { return n.AuditEntries[i].ID < n.AuditEntries[j].ID })
+
+	return &n
+}
+
+func normaliseModel(model *gorm.Model) {
+	model.CreatedAt = *normaliseTime(&model.CreatedAt)
+	model.UpdatedAt = *normaliseTime(&model.UpdatedAt)
+	model.DeletedAt = normaliseTime(model.DeletedAt)
+}
+
+func normaliseTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	normalised := t.UTC().Truncate(time.Second)
+	return &normalised
+}
+
+func contentHash(v interface{}) string {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		// Everything we hash came from (or could go into) a dump, so this
+		//  really shouldn't be possible
+		panic(err)
+	}
+	return sha256Hex(jsonBytes)
+}
+
+// A hash of everything in an exception, including its comments, files etc,
+// that's the same for a dump and the database if and only if importing the
+// one would change nothing in the other.
+func exceptionContentHash(exception *Exception) string {
+	return contentHash(normaliseForComparison(exception))
+}
+
+func describeExceptionDifferences(old *Exception, new *Exception) []string {
+	old, new = normaliseForComparison(old), normaliseForComparison(new)
+
+	var differences []string
+	compare := func(field string, oldValue string, newValue string) {
+		if oldValue != newValue {
+			differences = append(differences, fmt.Sprintf("%s: %q -> %q", field, oldValue, newValue))
+		}
+	}
+	compare("Username", old.Username, new.Username)
+	compare("Service", old.Service, new.Service)
+	compare("ExceptionType", old.ExceptionType, new.ExceptionType)
+	compare("ExceptionDetail", old.ExceptionDetail, new.ExceptionDetail)
+	compare("Status", old.Status, new.Status)
+	compare("SubmittedDate", timeForDiff(old.SubmittedDate), timeForDiff(new.SubmittedDate))
+	compare("StartDate", timeForDiff(old.StartDate), timeForDiff(new.StartDate))
+	compare("EndDate", timeForDiff(old.EndDate), timeForDiff(new.EndDate))
+	compare("CreatedAt", timeForDiff(&old.CreatedAt), timeForDiff(&new.CreatedAt))
+	compare("UpdatedAt", timeForDiff(&old.UpdatedAt), timeForDiff(&new.UpdatedAt))
+	compare("DeletedAt", timeForDiff(old.DeletedAt), timeForDiff(new.DeletedAt))
+
+	// Comments etc that are only in the database aren't differences as far
+	//  as we're concerned, since nothing but --mode=replace removes them
+	oldChildren, newChildren := childHashes(old), childHashes(new)
+	for _, kind := range []string{"comment", "file", "status change", "audit entry"} {
+		var ids []uint
+		for id := range newChildren[kind] {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		for _, id := range ids {
+			oldHash, inOld := oldChildren[kind][id]
+			if !inOld {
+				differences = append(differences, fmt.Sprintf("%s %d added", kind, id))
+			} else if oldHash != newChildren[kind][id] {
+				differences = append(differences, fmt.Sprintf("%s %d changed", kind, id))
+			}
+		}
+	}
+	return differences
+}
+
+func childHashes(exception *Exception) map[string]map[uint]string {
+	hashes := map[string]map[uint]string{
+		"comment":       make(map[uint]string),
+		"file":          make(map[uint]string),
+		"status change": make(map[uint]string),
+		"audit entry":   make(map[uint]string),
+	}
+	for _, v := range exception.Comments {
+		hashes["comment"][v.ID] = contentHash(v)
+	}
+	for _, v := range exception.FormFiles {
+		hashes["file"][v.ID] = contentHash(v)
+	}
+	for _, v := range exception.StatusChanges {
+		hashes["status change"][v.ID] = contentHash(v)
+	}
+	for _, v := range exception.AuditEntries {
+		hashes["audit entry"][v.ID] = contentHash(v)
+	}
+	return hashes
+}
+
+func timeForDiff(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -1,54 +1,350 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
 )
 
-func dumpAllAsJson() {
-	var allExceptions []Exception
-	db := getDB()
-	defer db.Close()
-	db.Preload("Comments").Preload("FormFiles").Preload("StatusChanges").Find(&allExceptions)
-	jsonBytes, err := json.MarshalIndent(allExceptions, "", " ")
+// Bump this whenever the layout of a dump changes (as opposed to what's in
+// the exceptions, which is schemaVersion's job).
+const dumpFormatVersion = 1
+
+// How many exceptions to load from the database at once while dumping: big
+// enough to keep the number of queries down, small enough that we're never
+// holding too many attached files in memory.
+const dumpBatchSize = 50
+
+// The header fields of a dump, which come before the exceptions so that
+// importjson can check them before it starts reading records. Since and IDs
+// are only set for partial dumps, and FilesOmitted means the FormFiles have
+// only their SHA256 to go on, and no FileContents.
+type dumpHeader struct {
+	FormatVersion int       `json:"format_version"`
+	SchemaVersion int       `json:"schema_version"`
+	ToolCommit    string    `json:"tool_commit"`
+	DumpedAt      time.Time `json:"dumped_at"`
+	FilesOmitted  bool      `json:"files_omitted"`
+	Since         string    `json:"since,omitempty"`
+	IDs           []uint    `json:"ids,omitempty"`
+}
+
+func (header *dumpHeader) isPartial() bool {
+	return header.FilesOmitted || header.Since != "" || len(header.IDs) != 0
+}
+
+// How many of each kind of record a dump or backup has in it.
+type recordCounts struct {
+	Exceptions    int `json:"exceptions"`
+	Comments      int `json:"comments"`
+	Files         int `json:"files"`
+	StatusChanges int `json:"status_changes"`
+	AuditEntries  int `json:"audit_entries"`
+}
+
+func (counts *recordCounts) add(exception *Exception) {
+	counts.Exceptions++
+	counts.Comments += len(exception.Comments)
+	counts.Files += len(exception.FormFiles)
+	counts.StatusChanges += len(exception.StatusChanges)
+	counts.AuditEntries += len(exception.AuditEntries)
+}
+
+func (counts recordCounts) String() string {
+	return fmt.Sprintf("%d exceptions, %d comments, %d files, %d status changes, %d audit entries",
+		counts.Exceptions, counts.Comments, counts.Files, counts.StatusChanges, counts.AuditEntries)
+}
+
+func dumpAllAsJson(ac *appContext, noFiles bool, since string, ids string) error {
+	out := bufio.NewWriter(os.Stdout)
+	_, _, err := writeDump(ac, out, noFiles, since, ids, false)
+	flushErr := out.Flush()
+	if err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// Writes the dump one batch of exceptions at a time, rather than building
+// the whole thing in memory first. Returns how many of everything it wrote,
+// and the IDs of the files it included.
+//
+// Soft-deleted exceptions, comments, files etc are left out, unless
+// withDeleted is set, in which case they're included, with their DeletedAt.
+func writeDump(ac *appContext, out io.Writer, noFiles bool, since string, ids string, withDeleted bool) (recordCounts, []uint, error) {
+	var counts recordCounts
+	var fileIDs []uint
+
+	header := dumpHeader{
+		FormatVersion: dumpFormatVersion,
+		SchemaVersion: schemaVersion,
+		ToolCommit:    commitLabel,
+		DumpedAt:      time.Now(),
+		FilesOmitted:  noFiles,
+		Since:         since,
+	}
+
+	db := ac.db
+	// Preloads don't inherit Unscoped, so they each need telling
+	var preloadConditions []interface{}
+	if withDeleted {
+		db = db.Unscoped()
+		preloadConditions = append(preloadConditions, func(db *gorm.DB) *gorm.DB { return db.Unscoped() })
+	}
+
+	query := db.Model(&Exception{})
+	if since != "" {
+		sinceDate, err := ac.dateParser().parse(since)
+		if err != nil {
+			return counts, nil, usageErrorf("could not parse --since: %s", err)
+		}
+		// The header says which date it was, since "-30d" and the like
+		//  would mean something else by the time anyone reads it
+		header.Since = stringFromDate(&sinceDate)
+		sinceTime := startsAt(sinceDate, ac.config.location)
+		// Adding a comment, file etc doesn't touch the exception's
+		//  UpdatedAt, so those have to be checked too
+		changedSince := ac.dialect.TimeColumn("updated_at") + " >= " + ac.dialect.TimeColumn("?")
+		conditions := []string{changedSince}
+		args := []interface{}{sinceTime}
+		for _, model := range []interface{}{&Comment{}, &FormFile{}, &StatusChange{}, &AuditEntry{}} {
+			conditions = append(conditions, "id IN (?)")
+			args = append(args, db.Model(model).Select("exception_id").Where(changedSince, sinceTime).QueryExpr())
+		}
+		query = query.Where(strings.Join(conditions, " OR "), args...)
+	}
+	if ids != "" {
+		for _, v := range strings.Split(ids, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(v), 10, 0)
+			if err != nil {
+				return counts, nil, usageErrorf("could not parse --ids: %q is not an exception ID", v)
+			}
+			header.IDs = append(header.IDs, uint(id))
+		}
+		query = query.Where("id IN (?)", header.IDs)
+	}
 
+	var exceptionIDs []uint
+	err := query.Order("id").Pluck("id", &exceptionIDs).Error
+	if err != nil {
+		return counts, nil, dbError(err)
+	}
+
+	if len(header.IDs) != 0 {
+		found := make(map[uint]bool)
+		for _, id := range exceptionIDs {
+			found[id] = true
+		}
+		for _, id := range header.IDs {
+			if !found[id] {
+				return counts, nil, notFoundErrorf("no record of exception %d", id)
+			}
+		}
+	}
+
+	headerBytes, err := json.MarshalIndent(header, "", " ")
+	if err != nil {
+		return counts, nil, err
+	}
+	// Leave the object open so the exceptions can go in it
+	headerBytes = bytes.TrimSuffix(headerBytes, []byte("\n}"))
+	_, err = fmt.Fprintf(out, "%s,\n \"exceptions\": [", headerBytes)
 	if err != nil {
-		panic(err)
+		return counts, nil, err
 	}
-	fmt.Println(string(jsonBytes))
-	return
+
+	for start := 0; start < len(exceptionIDs); start += dumpBatchSize {
+		end := start + dumpBatchSize
+		if end > len(exceptionIDs) {
+			end = len(exceptionIDs)
+		}
+
+		var exceptions []Exception
+		err = db.Preload("Comments", preloadConditions...).
+			Preload("FormFiles", preloadConditions...).
+			Preload("StatusChanges", preloadConditions...).
+			Preload("AuditEntries", preloadConditions...).
+			Where("id IN (?)", exceptionIDs[start:end]).
+			Order("id").
+			Find(&exceptions).Error
+		if err != nil {
+			return counts, nil, dbError(err)
+		}
+
+		for i := range exceptions {
+			for j := range exceptions[i].FormFiles {
+				file := &exceptions[i].FormFiles[j]
+				fileIDs = append(fileIDs, file.ID)
+				if noFiles {
+					file.FileContents = nil
+				} else {
+					// Dumps always have the contents in, wherever
+					//  they're stored
+					file.FileContents, err = ac.storedContents(file)
+					if err != nil {
+						return counts, nil, err
+					}
+				}
+			}
+			counts.add(&exceptions[i])
+
+			jsonBytes, err := json.MarshalIndent(exceptions[i], "  ", " ")
+			if err != nil {
+				return counts, nil, err
+			}
+			separator := ","
+			if start+i == 0 {
+				separator = ""
+			}
+			_, err = fmt.Fprintf(out, "%s\n  %s", separator, jsonBytes)
+			if err != nil {
+				return counts, nil, err
+			}
+		}
+	}
+
+	_, err = io.WriteString(out, "\n ]\n}\n")
+	return counts, fileIDs, err
 }
 
-func importAllAsJson() {
-	var exceptionsImport []Exception
-	buffer, err := ioutil.ReadAll(os.Stdin)
+// Reads exceptions out of a dump one at a time, so that we never need to
+// hold a whole (possibly very large) dump in memory.
+//
+// Understands both the current format, an object with the header fields
+// followed by an "exceptions" array, and the bare array that older versions
+// wrote, which it treats as schema version 1. Input that's been gzipped is
+// decompressed on the way in.
+//
+// Which header fields there are is up to dumpHeader: they're gathered up as
+// they come and only decoded into it once we reach the exceptions.
+type dumpReader struct {
+	decoder *json.Decoder
+	header  dumpHeader
+}
 
+func newDumpReader(input io.Reader) (*dumpReader, error) {
+	input, err := maybeGunzip(input)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	err = json.Unmarshal(buffer, &exceptionsImport)
+	reader := &dumpReader{decoder: json.NewDecoder(input)}
 
+	token, err := reader.decoder.Token()
 	if err != nil {
-		panic(err)
+		return nil, validationErrorf("could not parse import data: %s", err)
+	}
+
+	if token == json.Delim('[') {
+		reader.header.SchemaVersion = 1
+		return reader, reader.checkHeader()
+	}
+	if token != json.Delim('{') {
+		return nil, validationErrorf("could not parse import data: expected a JSON object or array")
+	}
+
+	headerFields := make(map[string]json.RawMessage)
+	for reader.decoder.More() {
+		token, err = reader.decoder.Token()
+		if err != nil {
+			return nil, validationErrorf("could not parse import data: %s", err)
+		}
+		key, _ := token.(string)
+
+		if key != "exceptions" {
+			var value json.RawMessage
+			err = reader.decoder.Decode(&value)
+			if err != nil {
+				return nil, validationErrorf("could not parse import data: %s", err)
+			}
+			headerFields[key] = value
+			continue
+		}
+
+		// Fields we don't know about are ignored, rather than refusing
+		//  dumps from newer versions that only added some
+		headerBytes, _ := json.Marshal(headerFields)
+		err = json.Unmarshal(headerBytes, &reader.header)
+		if err != nil {
+			return nil, validationErrorf("could not parse import data header: %s", err)
+		}
+		err = reader.checkHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		token, err = reader.decoder.Token()
+		if err != nil || token != json.Delim('[') {
+			return nil, validationErrorf("could not parse import data: exceptions should be an array")
+		}
+		return reader, nil
+	}
+	return nil, validationErrorf("could not parse import data: no exceptions found")
+}
+
+func (reader *dumpReader) checkHeader() error {
+	if reader.header.SchemaVersion == 0 {
+		return validationErrorf("import data has no schema_version before its exceptions")
+	}
+	if reader.header.FormatVersion > dumpFormatVersion {
+		return validationErrorf("import data is in dump format version %d, but this version of the tool only understands up to %d: use a newer version to import it", reader.header.FormatVersion, dumpFormatVersion)
 	}
+	if reader.header.SchemaVersion > schemaVersion {
+		return validationErrorf("import data is from schema version %d, but this version of the tool only understands up to %d: use a newer version to import it", reader.header.SchemaVersion, schemaVersion)
+	}
+	return nil
+}
 
-	db := getDB()
-	defer db.Close()
-	importTransaction := db.Begin()
+// Returns the next exception, or io.EOF once they've all been read.
+func (reader *dumpReader) Next() (*Exception, error) {
+	if !reader.decoder.More() {
+		return nil, io.EOF
+	}
+	exception := &Exception{}
+	err := reader.decoder.Decode(exception)
+	if err != nil {
+		return nil, validationErrorf("could not parse import data: %s", err)
+	}
 
-	for _, e := range exceptionsImport {
-		errs := db.Save(&e).GetErrors()
-		if len(errs) != 0 {
-			log.Print(errs)
-			importTransaction.Rollback()
-			break
+	// Dumps from before schema versions 3 and 4 don't have these, and
+	//  their files are never compressed
+	if !reader.header.FilesOmitted {
+		for i := range exception.FormFiles {
+			file := &exception.FormFiles[i]
+			if file.SHA256 == "" {
+				file.SHA256 = sha256Hex(file.FileContents)
+				file.Size = int64(len(file.FileContents))
+			}
+			if file.MIMEType == "" {
+				file.MIMEType = detectMIMEType(file.FileName, file.FileContents)
+			}
 		}
 	}
-	importTransaction.Commit()
+	return exception, nil
+}
 
-	return
+// gzip files always start with these two bytes, and JSON never can.
+func maybeGunzip(input io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(input)
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("could not read import data: %s", err)
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		unzipped, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, validationErrorf("could not decompress import data: %s", err)
+		}
+		return unzipped, nil
+	}
+	return buffered, nil
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Comments are written in an editor, so they tend to have paragraphs,
+// lists and the odd pasted command in them, written as light Markdown.
+// renderMarkdown lays them out to fit a width, keeping all of that, and
+// with styled set, shows emphasis and code with ANSI codes. Without it,
+// the emphasis markers are just dropped.
+//
+// It only knows about paragraphs, # headings, -, * and 1. lists, fenced
+// or indented code blocks, and **bold**, *italic* and `code` inside them:
+// anything else is left as it was written.
+
+const (
+	styleBold = 1 << iota
+	styleItalic
+	styleCode
+)
+
+var styleCodes = []struct {
+	style int
+	code  string
+}{
+	{styleBold, colorMap["BOLD"]},
+	{styleItalic, "\u001b[3m"},
+	{styleCode, colorMap["CYAN"]},
+}
+
+var (
+	headingRegexp  = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*$`)
+	listItemRegexp = regexp.MustCompile(`^(\s*)([-*+]|\d+[.)])\s+(.*)$`)
+)
+
+type markdownBlockKind int
+
+const (
+	paragraphBlock markdownBlockKind = iota
+	headingBlock
+	listItemBlock
+	codeBlock
+)
+
+type markdownBlock struct {
+	kind markdownBlockKind
+	// For list items, how far in the marker is, and the marker itself
+	indent int
+	marker string
+	lines  []string
+	// Set if there was a blank line before this block
+	spaced bool
+}
+
+func renderMarkdown(text string, width int, styled bool) string {
+	var rendered []string
+	for i, block := range parseMarkdownBlocks(text) {
+		if block.spaced && i > 0 {
+			rendered = append(rendered, "")
+		}
+		switch block.kind {
+		case codeBlock:
+			// Indented, so it still stands out without any styling
+			for _, line := range block.lines {
+				if styled && line != "" {
+					line = colorMap["CYAN"] + line + colorMap["RESET"]
+				}
+				rendered = append(rendered, strings.TrimRight("    "+line, " "))
+			}
+		case headingBlock:
+			segments := parseInlineMarkdown(block.lines[0])
+			for i := range segments {
+				segments[i].style |= styleBold
+			}
+			rendered = append(rendered, wrapSegments(segments, "", "", width, styled)...)
+		case listItemBlock:
+			first := strings.Repeat(" ", block.indent) + block.marker + " "
+			rest := strings.Repeat(" ", len(first))
+			rendered = append(rendered, wrapSegments(parseInlineMarkdown(strings.Join(block.lines, " ")), first, rest, width, styled)...)
+		default:
+			rendered = append(rendered, wrapSegments(parseInlineMarkdown(strings.Join(block.lines, " ")), "", "", width, styled)...)
+		}
+	}
+	return strings.Join(rendered, "\n")
+}
+
+func parseMarkdownBlocks(text string) []markdownBlock {
+	lines := strings.Split(strings.Replace(strings.TrimSpace(text), "\r\n", "\n", -1), "\n")
+
+	var blocks []markdownBlock
+	var current *markdownBlock
+	spaced := false
+	start := func(kind markdownBlockKind) *markdownBlock {
+		blocks = append(blocks, markdownBlock{kind: kind, spaced: spaced})
+		spaced = false
+		return &blocks[len(blocks)-1]
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(strings.Replace(lines[i], "\t", "    ", -1), " ")
+		// Lines ending in two spaces or a backslash are meant to end there
+		lineEnd := ""
+		if line != "" && (strings.HasSuffix(lines[i], "  ") || strings.HasSuffix(line, "\\")) {
+			line = strings.TrimSuffix(line, "\\")
+			lineEnd = "\n"
+		}
+
+		if line == "" {
+			current = nil
+			spaced = true
+			continue
+		}
+
+		// Fenced code runs until the closing fence, or the end if there isn't one
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			current = start(codeBlock)
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				current.lines = append(current.lines, strings.TrimRight(strings.Replace(lines[i], "\t", "    ", -1), " "))
+			}
+			current = nil
+			continue
+		}
+
+		// Indented code has to start a block of its own, or it'd be a
+		// continuation of a list item
+		if strings.HasPrefix(line, "    ") && current == nil {
+			current = start(codeBlock)
+			for ; i < len(lines); i++ {
+				next := strings.TrimRight(strings.Replace(lines[i], "\t", "    ", -1), " ")
+				if next != "" && !strings.HasPrefix(next, "    ") {
+					break
+				}
+				current.lines = append(current.lines, strings.TrimPrefix(next, "    "))
+			}
+			i--
+			// Blank lines after the code belong between it and what's next
+			for len(current.lines) > 0 && current.lines[len(current.lines)-1] == "" {
+				current.lines = current.lines[:len(current.lines)-1]
+				spaced = true
+			}
+			current = nil
+			continue
+		}
+
+		if match := headingRegexp.FindStringSubmatch(line); match != nil {
+			start(headingBlock).lines = []string{match[1]}
+			current = nil
+			continue
+		}
+
+		if match := listItemRegexp.FindStringSubmatch(line); match != nil {
+			current = start(listItemBlock)
+			current.indent = len(match[1])
+			current.marker = match[2]
+			current.lines = []string{strings.TrimLeft(match[3], " ") + lineEnd}
+			continue
+		}
+
+		if current == nil || current.kind == codeBlock || current.kind == headingBlock {
+			current = start(paragraphBlock)
+		}
+		current.lines = append(current.lines, strings.TrimLeft(line, " ")+lineEnd)
+	}
+	return blocks
+}
+
+type textSegment struct {
+	text  string
+	style int
+}
+
+// Splits a paragraph into runs of text with the same style. Markers only
+// count if they're closed later on, and _ only counts at the edges of
+// words, so usernames and file names with underscores in come out as
+// written.
+func parseInlineMarkdown(text string) []textSegment {
+	var segments []textSegment
+	var current strings.Builder
+	style := 0
+	flush := func() {
+		if current.Len() > 0 {
+			segments = append(segments, textSegment{text: current.String(), style: style})
+			current.Reset()
+		}
+	}
+
+	for i := 0; i < len(text); i++ {
+		rest := text[i:]
+		switch {
+		case rest[0] == '`' && strings.IndexByte(rest[1:], '`') >= 0:
+			flush()
+			end := strings.IndexByte(rest[1:], '`') + 1
+			segments = append(segments, textSegment{text: rest[1:end], style: style | styleCode})
+			i += end
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			marker := rest[:2]
+			if style&styleBold != 0 || (len(rest) > 2 && rest[2] != ' ' && strings.Contains(rest[2:], marker)) {
+				flush()
+				style ^= styleBold
+				i++
+			} else {
+				current.WriteString(marker)
+				i++
+			}
+		case rest[0] == '*' || rest[0] == '_':
+			opening := style&styleItalic == 0
+			var counts bool
+			if opening {
+				counts = len(rest) > 1 && rest[1] != ' ' && strings.IndexByte(rest[1:], rest[0]) >= 0 &&
+					(rest[0] == '*' || i == 0 || !isWordByte(text[i-1]))
+			} else {
+				counts = i > 0 && text[i-1] != ' ' && (rest[0] == '*' || len(rest) == 1 || !isWordByte(rest[1]))
+			}
+			if counts {
+				flush()
+				style ^= styleItalic
+			} else {
+				current.WriteByte(rest[0])
+			}
+		default:
+			current.WriteByte(rest[0])
+		}
+	}
+	flush()
+	return segments
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9')
+}
+
+// A word can be made of more than one segment, e.g. "**this**," is a
+// bold "this" and a plain ",". A nil word is a line break.
+type styledWord []textSegment
+
+func (word styledWord) width() int {
+	width := 0
+	for _, segment := range word {
+		width += tablewriter.DisplayWidth(segment.text)
+	}
+	return width
+}
+
+// Fills lines up to width with words, starting the first with firstPrefix
+// and the rest with restPrefix. Styles are reset at the end of every line,
+// and set again at the start of the next, so they don't leak into
+// whatever's printed alongside. A word that's longer than a whole line
+// gets a line to itself.
+func wrapSegments(segments []textSegment, firstPrefix, restPrefix string, width int, styled bool) []string {
+	var words []styledWord
+	var word styledWord
+	for _, segment := range segments {
+		for i, segmentLine := range strings.Split(segment.text, "\n") {
+			if i > 0 {
+				if len(word) > 0 {
+					words = append(words, word)
+					word = nil
+				}
+				words = append(words, nil)
+			}
+			for j, part := range strings.Split(segmentLine, " ") {
+				if j > 0 && len(word) > 0 {
+					words = append(words, word)
+					word = nil
+				}
+				if part != "" {
+					word = append(word, textSegment{text: part, style: segment.style})
+				}
+			}
+		}
+	}
+	if len(word) > 0 {
+		words = append(words, word)
+	}
+
+	var lines []string
+	var line strings.Builder
+	prefix := firstPrefix
+	lineWidth := 0
+	lineStyle := 0
+	finishLine := func() {
+		if lineStyle != 0 {
+			line.WriteString(colorMap["RESET"])
+		}
+		lines = append(lines, prefix+line.String())
+		line.Reset()
+		prefix = restPrefix
+		lineWidth = 0
+		lineStyle = 0
+	}
+
+	for _, word := range words {
+		if word == nil {
+			finishLine()
+			continue
+		}
+		wordWidth := word.width()
+		if lineWidth > 0 && len(prefix)+lineWidth+1+wordWidth > width {
+			finishLine()
+		}
+		if lineWidth > 0 {
+			line.WriteString(" ")
+			lineWidth++
+		}
+		for _, segment := range word {
+			if styled && segment.style != lineStyle {
+				line.WriteString(styleEscape(lineStyle, segment.style))
+				lineStyle = segment.style
+			}
+			line.WriteString(segment.text)
+		}
+		lineWidth += wordWidth
+	}
+	if lineWidth > 0 || len(lines) == 0 {
+		finishLine()
+	}
+	return lines
+}
+
+// The codes to switch from one style to another.
+func styleEscape(from, style int) string {
+	escape := ""
+	if from != 0 {
+		escape = colorMap["RESET"]
+	}
+	for _, v := range styleCodes {
+		if style&v.style != 0 {
+			escape += v.code
+		}
+	}
+	return escape
+}
+
+// For the rest of a table that has comments in it: plain text, wrapped to
+// width, since the table can't wrap some cells and not others.
+func wrapText(text string, width int) string {
+	segments := []textSegment{{text: strings.Join(strings.Fields(text), " ")}}
+	return strings.Join(wrapSegments(segments, "", "", width, false), "\n")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Exceptions in these states don't apply to anyone any more (or never
+// did), so it doesn't matter what they overlap with.
+var nonOverlappingStatuses = []string{"rejected", "removed"}
+
+// Whether two exceptions are for the same thing for the same person at
+// any of the same time. Dates are inclusive, so one ending on the day the
+// other starts counts. A missing date is taken as open-ended, since it's
+// better to warn about an overlap that isn't there than miss one that is.
+func (exception *Exception) overlaps(other *Exception) bool {
+	if exception.ID == other.ID && exception.ID != 0 {
+		return false
+	}
+	if exception.Username != other.Username ||
+		exception.Service != other.Service ||
+		exception.ExceptionType != other.ExceptionType {
+		return false
+	}
+	return !endsBefore(exception.EndDate, other.StartDate) && !endsBefore(other.EndDate, exception.StartDate)
+}
+
+func endsBefore(end *time.Time, start *time.Time) bool {
+	if end == nil || start == nil {
+		return false
+	}
+	return end.Before(*start)
+}
+
+// Finds the existing exceptions that a new or changed one overlaps with.
+// The dates are compared here rather than in SQL, because there are only
+// ever a handful of exceptions per user, and every database compares
+// dates differently.
+func findOverlapping(db *gorm.DB, exception *Exception) ([]Exception, error) {
+	var candidates []Exception
+	err := db.Where("username = ? AND service = ? AND exception_type = ? AND status NOT IN (?)",
+		exception.Username, exception.Service, exception.ExceptionType, nonOverlappingStatuses).
+		Order("id").
+		Find(&candidates).Error
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	var overlapping []Exception
+	for i := range candidates {
+		if exception.overlaps(&candidates[i]) {
+			overlapping = append(overlapping, candidates[i])
+		}
+	}
+	return overlapping, nil
+}
+
+// Every exception that overlaps with at least one other, for
+// `list overlapping`.
+func overlappingExceptions(exceptions []Exception) []Exception {
+	groups := make(map[string][]*Exception)
+	for i := range exceptions {
+		ex := &exceptions[i]
+		key := strings.Join([]string{ex.Username, ex.Service, ex.ExceptionType}, "\x00")
+		groups[key] = append(groups[key], ex)
+	}
+
+	found := make(map[uint]bool)
+	for _, group := range groups {
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				if group[i].overlaps(group[j]) {
+					found[group[i].ID] = true
+					found[group[j].ID] = true
+				}
+			}
+		}
+	}
+
+	var overlapping []Exception
+	for _, ex := range exceptions {
+		if found[ex.ID] {
+			overlapping = append(overlapping, ex)
+		}
+	}
+	sort.Slice(overlapping, func(i, j int) bool { return overlapping[i].ID < overlapping[j].ID })
+	return overlapping
+}
+
+// Shows the existing exceptions that exception overlaps with, and refuses
+// to go on unless allowOverlap is set. Meant to be called before the
+// exception is saved, so a refusal leaves nothing behind.
+func checkForOverlaps(ac *appContext, exception *Exception, allowOverlap bool) ([]Exception, error) {
+	overlapping, err := findOverlapping(ac.db, exception)
+	if err != nil || len(overlapping) == 0 {
+		return nil, err
+	}
+
+	log.Printf("Warning: %s already has %d %s %s exception(s) for some of the same dates:",
+		exception.Username, len(overlapping), exception.Service, exception.ExceptionType)
+	err = printExceptionTableSummary(ac, overlapping)
+	if err != nil {
+		return nil, err
+	}
+	if !allowOverlap {
+		return nil, validationErrorf("exception overlaps with %s -- use --allow-overlap if that's intended", idList(overlapping))
+	}
+	return overlapping, nil
+}
+
+// Records that an exception was allowed to overlap with others, once it
+// has an ID to record it against.
+func recordOverlapAllowed(db *gorm.DB, exceptionID uint, overlapping []Exception) error {
+	if len(overlapping) == 0 {
+		return nil
+	}
+	return recordAudit(db, exceptionID, "allow overlap", "overlaps with "+idList(overlapping))
+}
+
+func idList(exceptions []Exception) string {
+	ids := make([]string, 0, len(exceptions))
+	for _, ex := range exceptions {
+		ids = append(ids, fmt.Sprintf("%d", ex.ID))
+	}
+	return strings.Join(ids, ", ")
+}
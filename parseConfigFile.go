@@ -3,21 +3,52 @@ package main
 import (
 	"bytes"
 	"encoding/json" // While I recognise that JSON is not ideal, it was either this or XML without adding another dependency
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Example Connection Strings:
 //  for sqlite3: just a filename
 //  for MySQL: "test:blah@tcp(127.0.0.1)/test_exceptions"
+//  for PostgreSQL: "host=127.0.0.1 user=test dbname=test_exceptions sslmode=disable"
 // We append our own parameters for MySQL so if you use any here with ? it won't work -- this hasn't been a problem so far
 type DBConfig struct {
 	// Yes this is barebones, but trying to work out how to handle the connection parameters in a more cunning way was making my head hurt
-	DBType             string `json:"db_type"` // to pass to gorm.Open, if you want to use something other than "sqlite3" or "mysql" you'll have to add the drivers over in db.go
+	DBType             string `json:"db_type"` // "mysql", "postgres" or "sqlite3" -- if you want to use something else you'll have to add a dialect over in dialect.go
 	DBConnectionString string `json:"db_connection_string"`
+	// Optional: files bigger than this can't be attached, e.g. "500KB", "15MB" -- defaults to defaultMaxAttachmentSize
+	MaxAttachmentSize string `json:"max_attachment_size"`
+	// Optional: "zstd" (the default), "gzip" or "none", for how attached files are compressed when it's worth it
+	AttachmentCompression string `json:"attachment_compression"`
+	// Optional: where new attachments go -- "database" (the default), "directory" or "s3": see attachmentStore.go
+	AttachmentStore string `json:"attachment_store"`
+	// Needed for the "directory" store, and to read files that were put there
+	AttachmentDirectory string `json:"attachment_directory"`
+	// Needed for the "s3" store, and to read files that were put there
+	S3 *S3Config `json:"s3"`
+	// Optional: the longest each type of exception can last, e.g. {"queue": "3 months"} -- types
+	//  not listed have no limit. submit refuses anything longer without --force.
+	MaxDurations map[string]string `json:"max_durations"`
+	// Optional: terms and other named dates, for end-of-term and the like: see dates.go
+	AcademicCalendar *academicCalendar `json:"academic_calendar"`
+	// Optional: the time zone for working out what today is and when exceptions end, e.g.
+	//  "Europe/London" -- defaults to the local time zone
+	Timezone string `json:"timezone"`
+
+	// Parsed from the above by parseDBConfig
+	maxAttachmentBytes int64
+	compression        string
+	maxDurations       map[string]dateSpan
+	location           *time.Location
 }
 
+// MySQL's mediumblob tops out just under 16MB, so this leaves some headroom
+const defaultMaxAttachmentSize = "15MB"
+
 func getExampleConfigText() string {
 	return `{
 		"db_type": "sqlite3",
@@ -27,10 +58,10 @@ func getExampleConfigText() string {
 
 // genpw servexcep_rw 19072018
 
-func parseDBConfig(filename string) *DBConfig {
+func parseDBConfig(filename string) (*DBConfig, error) {
 	configFile, err := os.Open(filename)
 	if err != nil {
-		log.Fatal("Fatal error: could not open config file: ", err)
+		return nil, configErrorf("could not open config file: %s", err)
 	}
 	defer configFile.Close()
 
@@ -39,21 +70,111 @@ func parseDBConfig(filename string) *DBConfig {
 	buffer, err = ioutil.ReadAll(configFile)
 
 	if err != nil {
-		log.Println("Fatal error: could not read config file: " + filename)
-		panic(err)
+		return nil, configErrorf("could not read config file %s: %s", filename, err)
 	}
 
 	dbConfig := &DBConfig{}
 
 	err = json.Unmarshal(buffer, dbConfig)
 	if err != nil {
-		log.Println("Fatal error: could not parse config file: " + filename)
 		switch t := err.(type) {
 		case *json.SyntaxError:
-			log.Printf("Syntax error on line %d\n", 1+bytes.Count(buffer[0:t.Offset], []byte("\n")))
+			return nil, configErrorf("could not parse config file %s: syntax error on line %d: %s", filename, 1+bytes.Count(buffer[0:t.Offset], []byte("\n")), err)
 		}
-		panic(err)
+		return nil, configErrorf("could not parse config file %s: %s", filename, err)
+	}
+
+	if dbConfig.MaxAttachmentSize == "" {
+		dbConfig.MaxAttachmentSize = defaultMaxAttachmentSize
+	}
+	dbConfig.maxAttachmentBytes, err = parseSize(dbConfig.MaxAttachmentSize)
+	if err != nil {
+		return nil, configErrorf("could not parse max_attachment_size in config file %s: %s", filename, err)
+	}
+
+	switch dbConfig.AttachmentCompression {
+	case "", compressionZstd:
+		dbConfig.compression = compressionZstd
+	case compressionGzip:
+		dbConfig.compression = compressionGzip
+	case "none":
+		dbConfig.compression = compressionNone
+	default:
+		return nil, configErrorf("attachment_compression in config file %s should be \"zstd\", \"gzip\" or \"none\", not %q", filename, dbConfig.AttachmentCompression)
 	}
 
-	return dbConfig
+	switch dbConfig.AttachmentStore {
+	case "":
+		dbConfig.AttachmentStore = storageDatabase
+	case storageDatabase:
+	case storageDirectory:
+		if dbConfig.AttachmentDirectory == "" {
+			return nil, configErrorf("attachment_store in config file %s is \"directory\", but there's no attachment_directory", filename)
+		}
+	case storageS3:
+		if dbConfig.S3 == nil {
+			return nil, configErrorf("attachment_store in config file %s is \"s3\", but there's no s3 section", filename)
+		}
+	default:
+		return nil, configErrorf("attachment_store in config file %s should be one of %s, not %q", filename, strings.Join(storageNames, ", "), dbConfig.AttachmentStore)
+	}
+	if dbConfig.S3 != nil && (dbConfig.S3.Endpoint == "" || dbConfig.S3.Bucket == "") {
+		return nil, configErrorf("the s3 section of config file %s needs at least an endpoint and a bucket", filename)
+	}
+
+	dbConfig.maxDurations = make(map[string]dateSpan, len(dbConfig.MaxDurations))
+	for exceptionType, text := range dbConfig.MaxDurations {
+		_, err = filterSubmittedExceptionType(exceptionType)
+		if err != nil {
+			return nil, configErrorf("max_durations in config file %s has a limit for %q, which isn't a type of exception (should be one of %s)", filename, exceptionType, validExceptionTypesString)
+		}
+		dbConfig.maxDurations[strings.ToLower(exceptionType)], err = parseDateSpan(text)
+		if err != nil {
+			return nil, configErrorf("could not parse max_durations for %s in config file %s: %s", exceptionType, filename, err)
+		}
+	}
+
+	dbConfig.location = time.Local
+	if dbConfig.Timezone != "" {
+		dbConfig.location, err = time.LoadLocation(dbConfig.Timezone)
+		if err != nil {
+			return nil, configErrorf("could not understand timezone in config file %s: %s", filename, err)
+		}
+	}
+
+	if dbConfig.AcademicCalendar != nil {
+		err = dbConfig.AcademicCalendar.check()
+		if err != nil {
+			return nil, configErrorf("could not understand academic_calendar in config file %s: %s", filename, err)
+		}
+	}
+
+	return dbConfig, nil
+}
+
+// Sizes like "15MB": the units are all powers of 1024, and a bare number is in bytes.
+func parseSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GB", 1024 * 1024 * 1024},
+		{"MB", 1024 * 1024},
+		{"KB", 1024},
+		{"B", 1},
+	}
+	trimmed := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, v := range units {
+		if strings.HasSuffix(trimmed, v.suffix) {
+			trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, v.suffix))
+			multiplier = v.multiplier
+			break
+		}
+	}
+	number, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("%q is not a size (should be something like \"15MB\")", size)
+	}
+	return number * multiplier, nil
 }
@@ -3,13 +3,18 @@ package main
 import (
 	"fmt"
 	"strings"
+
+	"github.com/jinzhu/gorm"
 )
 
 // Gives a summary for the week of current state and things that will need to be done.
-func report() {
+func report(ac *appContext) error {
 	// Note: this produces YAML, but, really *dumb* YAML that looks like normal text
 	// Otherwise we could just use yaml.Marshal
-	reportData := gatherReportData()
+	reportData, err := gatherReportData(ac)
+	if err != nil {
+		return err
+	}
 	rs := "Report:\n" // Report string
 	for catName, longCatName := range map[string]string{
 		"decision waiting":         "Waiting for Decision",
@@ -26,6 +31,7 @@ func report() {
 		}
 	}
 	fmt.Print(rs)
+	return nil
 }
 
 func yamlListOfIDs(list []uint, indent int) string {
@@ -37,41 +43,56 @@ func yamlListOfIDs(list []uint, indent int) string {
 	return s
 }
 
-func gatherReportData() map[string][]uint {
-	timeNow := getDBTimeNow()
-	time5daysFromNow := getDBFutureTimes("5 day")
-	timeTwoWeeksFromNow := getDBFutureTimes("14 day")
+func gatherReportData(ac *appContext) (map[string][]uint, error) {
+	dialect := ac.dialect
+	today := ac.today()
+	timeNow := dialect.DateValue(today)
+	time5daysFromNow := dialect.DateValue(today.AddDate(0, 0, 5))
+	timeTwoWeeksFromNow := dialect.DateValue(today.AddDate(0, 0, 14))
+	startDate := dialect.DateColumn("start_date")
+	endDate := dialect.DateColumn("end_date")
 
-	rd := make(map[string][]uint)
 	// We want the count of and IDs of:
-	//   - things that are currently waiting for a decision
-	rd["decision waiting"] = getExceptionIDsWhere("status = 'undecided'")
-	//   - things that are currently waiting for implementation
-	rd["implementation waiting"] = getExceptionIDsWhere("status = 'approved' AND start_date > " + timeNow)
-	//   - things that are waiting to be removed
-	rd["removal waiting"] = getExceptionIDsWhere("status = 'implemented' AND end_date < " + timeNow)
-	//   - things that will expire within the next 5 days (ie. working week)
-	rd["expires within five days"] = getExceptionIDsWhere("status = 'implemented' AND end_date >= " + timeNow + " AND end_date < " + time5daysFromNow)
-	//   - things that will expire in the next 5-14 days (ie. their owner should be notified)
-	rd["expires within two weeks"] = getExceptionIDsWhere("status = 'implemented' AND end_date >= " + time5daysFromNow + " AND end_date < " + timeTwoWeeksFromNow)
+	conditions := map[string]string{
+		//   - things that are currently waiting for a decision
+		"decision waiting": "status = 'undecided'",
+		//   - things that are currently waiting for implementation
+		"implementation waiting": "status = 'approved' AND " + startDate + " > " + timeNow,
+		//   - things that are waiting to be removed
+		"removal waiting": "status = 'implemented' AND " + endDate + " < " + timeNow,
+		//   - things that will expire within the next 5 days (ie. working week)
+		"expires within five days": "status = 'implemented' AND " + endDate + " >= " + timeNow + " AND " + endDate + " < " + time5daysFromNow,
+		//   - things that will expire in the next 5-14 days (ie. their owner should be notified)
+		"expires within two weeks": "status = 'implemented' AND " + endDate + " >= " + time5daysFromNow + " AND " + endDate + " < " + timeTwoWeeksFromNow,
+	}
 
-	return rd
+	rd := make(map[string][]uint)
+	for catName, whereClause := range conditions {
+		ids, err := getExceptionIDsWhere(ac.db, whereClause)
+		if err != nil {
+			return nil, err
+		}
+		rd[catName] = ids
+	}
+
+	return rd, nil
 }
 
-func getExceptionIDsWhere(whereClause string) []uint {
-	exs := getExceptionsWhere(whereClause)
+func getExceptionIDsWhere(db *gorm.DB, whereClause string) ([]uint, error) {
+	exs, err := getExceptionsWhere(db, whereClause)
+	if err != nil {
+		return nil, err
+	}
 	exIDs := make([]uint, 0)
 	for _, v := range exs {
 		exIDs = append(exIDs, v.ID)
 	}
-	return exIDs
+	return exIDs, nil
 }
 
-func getExceptionsWhere(whereClause string) []Exception {
+func getExceptionsWhere(db *gorm.DB, whereClause string) ([]Exception, error) {
 	var listSet []Exception
-	db := getDB()
-	defer db.Close()
 
-	db.Where(whereClause).Find(&listSet)
-	return listSet
+	err := db.Where(whereClause).Find(&listSet).Error
+	return listSet, dbError(err)
 }
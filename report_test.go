@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The IDs listed under each section heading of a report.
+func reportedIDs(output string) map[string][]uint {
+	sections := make(map[string][]uint)
+	section := ""
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.HasPrefix(line, "  ") && !strings.HasPrefix(line, "   "):
+			section = strings.TrimSuffix(strings.TrimSpace(line), ":")
+		case strings.HasPrefix(strings.TrimSpace(line), "- "):
+			id, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(line), "- "), 10, 0)
+			if err == nil {
+				sections[section] = append(sections[section], uint(id))
+			}
+		}
+	}
+	return sections
+}
+
+func TestReport(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	seedListExceptions(t, ac)
+
+	got := reportedIDs(captureStdout(t, func() error { return report(ac) }))
+	// Sections with nothing in them are left out
+	want := map[string][]uint{
+		"Waiting for Decision":         {1, 8},
+		"Waiting for Implementation":   {2},
+		"Waiting for Removal":          {3},
+		"Will Expire Within Five Days": {4, 9},
+		"Will Expire Within Two Weeks": {5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("report: got %v, want %v", got, want)
+	}
+}
+
+func TestReportEmpty(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+
+	got := captureStdout(t, func() error { return report(ac) })
+	if got != "Report:\n" {
+		t.Errorf("report of an empty database: got %q, want just the heading", got)
+	}
+}
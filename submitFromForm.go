@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/olekukonko/tablewriter"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// The form we send out for people to fill in and send back, either as an
+// attachment or pasted into an email. It's plain "field: value" lines, so
+// it's also valid YAML for anyone who'd rather generate it.
+const formTemplate = `# Research Computing Service Exception Request
+#
+# Fill in the fields below and send this back to us, either attached to an
+# email or pasted into one. Lines starting with # are ignored.
+#
+# Dates are YYYY-MM-DD (or DD/MM/YYYY). Leave a field empty if you're not sure.
+
+# Your 7-character username
+username:
+
+# Which service this is for (` + "%s" + `)
+service:
+
+# What sort of exception you need (` + "%s" + `)
+type:
+
+# What you need: quota size, queue length, etc
+detail:
+
+# When you'd like the exception to start and end
+starts:
+ends:
+`
+
+func printFormTemplate() {
+	fmt.Printf(formTemplate, validServicesString, validExceptionTypesString)
+}
+
+// Everything needed to submit an exception, as read from a form by parseForm
+// (which leaves anything the form didn't have empty) or asked for by
+// askForSubmission.
+type submissionFields struct {
+	Username  string
+	Service   string
+	Type      string
+	Detail    string
+	Submitted string
+	Starts    string
+	Ends      string
+}
+
+// The names people (or our older forms) use for each field, after
+// normaliseFieldName. "From" and "To" would be obvious ones for the dates,
+// but in an email those are the addresses.
+var formFieldNames = map[string]string{
+	"username":        "username",
+	"user":            "username",
+	"userid":          "username",
+	"ucluserid":       "username",
+	"account":         "username",
+	"service":         "service",
+	"cluster":         "service",
+	"system":          "service",
+	"type":            "type",
+	"exceptiontype":   "type",
+	"requesttype":     "type",
+	"detail":          "detail",
+	"details":         "detail",
+	"exceptiondetail": "detail",
+	"submitted":       "submitted",
+	"submitteddate":   "submitted",
+	"datesubmitted":   "submitted",
+	"starts":          "starts",
+	"start":           "starts",
+	"startdate":       "starts",
+	"ends":            "ends",
+	"end":             "ends",
+	"enddate":         "ends",
+	"expires":         "ends",
+}
+
+var formLineRegexp = regexp.MustCompile(`^([A-Za-z][A-Za-z _-]*?)\s*[:=]\s*(.*)$`)
+
+func normaliseFieldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '_' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(name))
+}
+
+// Decodes the plain text of an email body, or of one part of it, and
+// reports whether there was any. Mail clients quite often send
+// quoted-printable or base64, and multipart/alternative with an HTML copy
+// alongside the text, in which case the first text/plain part is used.
+func emailText(contentType string, encoding string, body io.Reader) ([]byte, bool, error) {
+	mediaType := "text/plain"
+	var params map[string]string
+	if contentType != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				return nil, false, nil
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			// NextPart decodes quoted-printable itself, and then drops the
+			//  header, so this only sees the encodings it leaves alone
+			text, found, err := emailText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil || found {
+				return text, found, err
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return nil, false, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	text, err := ioutil.ReadAll(body)
+	return text, err == nil, err
+}
+
+// Reads a filled-in copy of formTemplate, or an email (or just its body)
+// with the same sort of "Field: value" lines in it. For an email, the Date
+// header is used as the submitted date unless the body says otherwise.
+// Replies quote with "> ", so that's ignored, and where a field appears more
+// than once, the first one wins, since that's the newest.
+func parseForm(filename string, dates dateParser) (*submissionFields, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, validationErrorf("could not read form: %s", err)
+	}
+	mimeType := detectMIMEType(filename, contents)
+	if !strings.HasPrefix(mimeType, "text/") && !strings.HasPrefix(mimeType, "message/") {
+		return nil, validationErrorf("could not read form %s: only text forms and emails can be read, not %s", filename, mimeType)
+	}
+
+	values := make(map[string]string)
+	body := contents
+	if message, err := mail.ReadMessage(bytes.NewReader(contents)); err == nil && message.Header.Get("Date") != "" {
+		sent, err := mail.ParseDate(message.Header.Get("Date"))
+		if err == nil {
+			values["submitted"] = stringFromDate(&sent)
+		}
+		var found bool
+		body, found, err = emailText(message.Header.Get("Content-Type"), message.Header.Get("Content-Transfer-Encoding"), message.Body)
+		if err != nil {
+			return nil, validationErrorf("could not read form: %s", err)
+		}
+		if !found {
+			return nil, validationErrorf("could not read form %s: the email has no plain text part", filename)
+		}
+	}
+
+	found := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimLeft(scanner.Text(), "> \t"))
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		match := formLineRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		field, ok := formFieldNames[normaliseFieldName(match[1])]
+		value := strings.Trim(strings.TrimSpace(match[2]), `"'`)
+		if !ok || value == "" || found[field] {
+			continue
+		}
+		found[field] = true
+		values[field] = value
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, validationErrorf("could not read form: %s", err)
+	}
+	if len(found) == 0 {
+		return nil, validationErrorf("could not find any form fields in %s", filename)
+	}
+
+	fields := &submissionFields{
+		Username:  values["username"],
+		Service:   values["service"],
+		Type:      values["type"],
+		Detail:    values["detail"],
+		Submitted: values["submitted"],
+		Starts:    values["starts"],
+		Ends:      values["ends"],
+	}
+	for _, date := range []string{fields.Submitted, fields.Starts, fields.Ends} {
+		if date != "" {
+			err = checkFormDate(date, dates)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fields, nil
+}
+
+// We ask for YYYY-MM-DD, but people write dates all sorts of ways: see
+// dates.go for what's understood. The dates are only checked here, and
+// left as written, since an end date like +6m can't be worked out until
+// the start date is known, which might come from --starts: fillInAndCheck
+// turns them into YYYY-MM-DD.
+func checkFormDate(date string, dates dateParser) error {
+	_, err := dates.parse(date)
+	if err != nil {
+		return validationErrorf("could not understand a date in the form: %s", err)
+	}
+	return nil
+}
+
+// Fills in anything the form didn't have from the command line (including
+// its defaults), and checks it all the same way submit would, so what's
+// confirmed is what will be created.
+func (fields *submissionFields) fillInAndCheck(dates dateParser, username, service, exceptionType, detail, submitted, starts, ends string) error {
+	for _, v := range []struct {
+		field    *string
+		fallback string
+	}{
+		{&fields.Username, username},
+		{&fields.Service, service},
+		{&fields.Type, exceptionType},
+		{&fields.Detail, detail},
+		{&fields.Submitted, submitted},
+		{&fields.Starts, starts},
+		{&fields.Ends, ends},
+	} {
+		if *v.field == "" {
+			*v.field = v.fallback
+		}
+	}
+
+	var err error
+	if fields.Username == "" {
+		return validationErrorf("the form has no username, and none was given with --username")
+	}
+	fields.Username, err = filterSubmittedUsername(fields.Username)
+	if err != nil {
+		return validationError(err)
+	}
+	fields.Service, err = filterSubmittedService(fields.Service)
+	if err != nil {
+		return validationError(err)
+	}
+	fields.Type, err = filterSubmittedExceptionType(fields.Type)
+	if err != nil {
+		return validationError(err)
+	}
+	if fields.Type == "quota" {
+		fields.Detail, err = tidyQuotaDetail(fields.Detail)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The options might have been things like +6m
+	submitDate, startDate, endDate, err := dates.exceptionDates(fields.Submitted, fields.Starts, fields.Ends)
+	if err != nil {
+		return err
+	}
+	fields.Submitted, fields.Starts, fields.Ends = stringFromDate(&submitDate), stringFromDate(&startDate), stringFromDate(&endDate)
+	return nil
+}
+
+// Checks a quota exception's detail is a size and what it's for, the same
+// as the wizard asks for them, and tidies the size up: "10 tb scratch"
+// becomes "10TB scratch". The size can have a space in it, so that's tried
+// first.
+func tidyQuotaDetail(detail string) (string, error) {
+	words := strings.Fields(detail)
+	for n := 2; n >= 1; n-- {
+		if len(words) <= n {
+			continue
+		}
+		size := strings.Join(words[:n], " ")
+		if ValidateStorageSpec(size) == nil {
+			size, _ = TidyStorageSpec(size)
+			return size + " " + strings.Join(words[n:], " "), nil
+		}
+	}
+	return "", validationErrorf("the detail for a quota exception should be a size like 500GB, 5TB or 2TiB and what it's for, like \"5TB Scratch\", not %q", detail)
+}
+
+// Checks what's about to be submitted the same way submitWithAllParts
+// will, so that anything it would refuse is refused before asking for
+// confirmation rather than after. What --force or --allow-overlap let
+// through is left for submitWithAllParts to warn about, so it's only
+// warned about once.
+func (fields *submissionFields) checkBeforeConfirming(ac *appContext, allowOverlap bool, force bool) error {
+	submitDate, startDate, endDate, err := ac.dateParser().exceptionDates(fields.Submitted, fields.Starts, fields.Ends)
+	if err != nil {
+		return err
+	}
+	if !force {
+		problems := dateProblems(submitDate, startDate, endDate, fields.Type, ac.config.maxDurations, ac.today())
+		if len(problems) != 0 {
+			return validationErrorf("%s -- use --force to submit it anyway", strings.Join(problems, "; "))
+		}
+	}
+	if !allowOverlap {
+		exception := Exception{Username: fields.Username, Service: fields.Service, ExceptionType: fields.Type,
+			SubmittedDate: &submitDate, StartDate: &startDate, EndDate: &endDate}
+		_, err = checkForOverlaps(ac, &exception, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shows what's about to be submitted and asks whether to go ahead, unless
+// assumeYes is set. Without a terminal to ask on, it has to be.
+func confirmSubmission(fields *submissionFields, formFilename string, assumeYes bool) (bool, error) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetBorder(false)
+	table.AppendBulk([][]string{
+		{"Username", fields.Username},
+		{"Service", fields.Service},
+		{"Type", fields.Type},
+		{"Detail", fields.Detail},
+		{"Submitted", fields.Submitted},
+		{"Starts", fields.Starts},
+		{"Ends", fields.Ends},
+	})
+	if formFilename != "" {
+		table.Append([]string{"Form", formFilename})
+	}
+	table.Render()
+
+	if assumeYes {
+		return true, nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return false, usageErrorf("cannot ask for confirmation without a terminal: use --yes to submit without asking")
+	}
+	confirmed := false
+	err := survey.AskOne(&survey.Confirm{Message: "Submit this exception?"}, &confirmed)
+	if err != nil {
+		return false, err
+	}
+	return confirmed, nil
+}
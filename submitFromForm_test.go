@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Writes contents to a file for parseForm to read.
+func writeForm(t *testing.T, name string, contents string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(filename, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func testDateParser() dateParser {
+	return dateParser{today: calendarDate(testNow)}
+}
+
+func TestParseForm(t *testing.T) {
+	filename := writeForm(t, "request_form.txt", `# Research Computing Service Exception Request
+# username: not this one, it's a comment
+username: zzzzzz9
+service: legion
+type: queue
+detail: "10 day jobs"
+submitted:
+starts: 01/02/2026
+ends: 2026-03-01
+`)
+	got, err := parseForm(filename, testDateParser())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := submissionFields{Username: "zzzzzz9", Service: "legion", Type: "queue", Detail: "10 day jobs",
+		Starts: "01/02/2026", Ends: "2026-03-01"}
+	if *got != want {
+		t.Errorf("parseForm: got %+v, want %+v", *got, want)
+	}
+}
+
+// Replies quote the request, and the newest answer comes first.
+func TestParseFormEmail(t *testing.T) {
+	for _, v := range []struct {
+		description string
+		contents    string
+		want        submissionFields
+	}{
+		{"a plain reply", `Date: Thu, 15 Jan 2026 10:00:00 +0000
+From: someone@example.com
+To: rc-support@example.com
+Subject: Re: Exception request
+
+Hi, here's the information you asked for:
+
+> User ID: yyyyyy8
+> Cluster: Grace
+> Type: access
+> Start date: 1st March 2026
+> End date: 31 August 2026
+>
+> > User ID: xxxxxx7
+`, submissionFields{Username: "yyyyyy8", Service: "Grace", Type: "access",
+			Submitted: "2026-01-15", Starts: "1st March 2026", Ends: "31 August 2026"}},
+		{"quoted-printable", `Date: Fri, 16 Jan 2026 09:30:00 +0000
+From: someone@example.com
+Subject: Exception request
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+User ID: yyyyyy8
+Cluster: Myriad
+Type: quota
+Detail: 10TB Scratch =E2=80=93 for the sequencing runs we have coming up over t=
+he summer
+`, submissionFields{Username: "yyyyyy8", Service: "Myriad", Type: "quota",
+			Detail:    "10TB Scratch \u2013 for the sequencing runs we have coming up over the summer",
+			Submitted: "2026-01-16"}},
+		{"multipart/alternative with base64 text", `Date: Sat, 17 Jan 2026 14:00:00 +0000
+From: someone@example.com
+Subject: Exception request
+MIME-Version: 1.0
+Content-Type: multipart/alternative; boundary="boundary42"
+
+--boundary42
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: base64
+
+VXNlciBJRDogeXl5eXl5OApDbHVzdGVyOiBLYXRobGVlbgpUeXBlOiBhY2Nlc3MK
+--boundary42
+Content-Type: text/html; charset=utf-8
+
+<p>User ID: xxxxxx7</p>
+--boundary42--
+`, submissionFields{Username: "yyyyyy8", Service: "Kathleen", Type: "access", Submitted: "2026-01-17"}},
+	} {
+		got, err := parseForm(writeForm(t, "request_email.eml", v.contents), testDateParser())
+		if err != nil {
+			t.Errorf("parseForm of an email with %s: %s", v.description, err)
+			continue
+		}
+		if *got != v.want {
+			t.Errorf("parseForm of an email with %s: got %+v, want %+v", v.description, *got, v.want)
+		}
+	}
+}
+
+func TestParseFormErrors(t *testing.T) {
+	for _, v := range []struct {
+		description string
+		contents    string
+	}{
+		{"no fields", "Nothing useful in here\n"},
+		{"a date that isn't one", "username: zzzzzz9\nstarts: sometime soon\n"},
+		{"not text", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"},
+	} {
+		_, err := parseForm(writeForm(t, "form", v.contents), testDateParser())
+		if exitCodeFor(err) != exitValidation {
+			t.Errorf("parseForm of a form with %s: got %v, want a validation error", v.description, err)
+		}
+	}
+}
+
+// Relative end dates count from the start date, wherever that came from.
+func TestFillInAndCheckDates(t *testing.T) {
+	for _, v := range []struct {
+		formStarts, formEnds string
+		starts, ends         string
+		wantStarts, wantEnds string
+	}{
+		{"2026-07-01", "+6m", "today", "", "2026-07-01", "2027-01-01"},
+		{"", "+6m", "2026-09-01", "", "2026-09-01", "2027-03-01"},
+		{"1st July 2026", "", "today", "+90d", "2026-07-01", "2026-09-29"},
+		{"", "", "today", "", "2026-06-15", "2027-06-15"},
+	} {
+		fields := &submissionFields{Username: "zzzzzz9", Starts: v.formStarts, Ends: v.formEnds}
+		err := fields.fillInAndCheck(testDateParser(), "", "myriad", "quota", "5TB Scratch", "today", v.starts, v.ends)
+		if err != nil {
+			t.Errorf("form dates %q to %q with --starts=%q --ends=%q: %s", v.formStarts, v.formEnds, v.starts, v.ends, err)
+			continue
+		}
+		if fields.Starts != v.wantStarts || fields.Ends != v.wantEnds {
+			t.Errorf("form dates %q to %q with --starts=%q --ends=%q: got %s to %s, want %s to %s",
+				v.formStarts, v.formEnds, v.starts, v.ends, fields.Starts, fields.Ends, v.wantStarts, v.wantEnds)
+		}
+	}
+}
+
+// A form's quota detail is checked and tidied the same as the wizard's.
+func TestFillInAndCheckQuotaDetail(t *testing.T) {
+	for _, v := range []struct {
+		detail string
+		want   string
+	}{
+		{"10 tb scratch", "10TB scratch"},
+		{"2tib Home", "2TiB Home"},
+		{"500GB  Project space", "500GB Project space"},
+		{"lots Scratch", ""},
+		{"10TB", ""},
+	} {
+		fields := &submissionFields{Username: "zzzzzz9", Type: "quota", Detail: v.detail}
+		err := fields.fillInAndCheck(testDateParser(), "", "myriad", "", "", "today", "today", "")
+		switch {
+		case v.want == "" && exitCodeFor(err) != exitValidation:
+			t.Errorf("quota detail %q: got %v, want a validation error", v.detail, err)
+		case v.want != "" && err != nil:
+			t.Errorf("quota detail %q: %s", v.detail, err)
+		case v.want != "" && fields.Detail != v.want:
+			t.Errorf("quota detail %q: got %q, want %q", v.detail, fields.Detail, v.want)
+		}
+	}
+
+	fields := &submissionFields{Username: "zzzzzz9", Type: "access", Detail: "ssh to the login nodes"}
+	err := fields.fillInAndCheck(testDateParser(), "", "myriad", "", "", "today", "today", "")
+	if err != nil || fields.Detail != "ssh to the login nodes" {
+		t.Errorf("access detail: got %q, %v, want it left alone", fields.Detail, err)
+	}
+}
+
+func TestCheckBeforeConfirming(t *testing.T) {
+	ac := newTestAppContext(t, testNow)
+	_, err := submitWithAllParts(ac, "aaaaaa1", "today", "2026-06-01", "2026-12-01", "myriad", "quota", "5TB Scratch", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		description         string
+		username            string
+		starts, ends        string
+		allowOverlap, force bool
+		ok                  bool
+	}{
+		{"a new exception", "aaaaaa2", "2026-07-01", "2027-01-01", false, false, true},
+		{"ending before it starts", "aaaaaa2", "2026-07-01", "2026-06-01", false, false, false},
+		{"ending before it starts with --force", "aaaaaa2", "2026-07-01", "2026-06-01", false, true, true},
+		{"overlapping", "aaaaaa1", "2026-07-01", "2027-01-01", false, false, false},
+		{"overlapping with --allow-overlap", "aaaaaa1", "2026-07-01", "2027-01-01", true, false, true},
+	} {
+		fields := &submissionFields{Username: v.username, Service: "myriad", Type: "quota", Detail: "5TB Scratch",
+			Submitted: "2026-06-15", Starts: v.starts, Ends: v.ends}
+		err := fields.checkBeforeConfirming(ac, v.allowOverlap, v.force)
+		if v.ok && err != nil {
+			t.Errorf("%s: %s", v.description, err)
+		}
+		if !v.ok && exitCodeFor(err) != exitValidation {
+			t.Errorf("%s: got %v, want a validation error", v.description, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AlecAivazis/survey/v2"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Asks for each part of a new exception in turn, checking each answer the
+// same way submit would. The command-line options (and their defaults)
+// become the defaults for the questions, so a partly-filled-in command line
+// only leaves the rest to ask about.
+func askForSubmission(dates dateParser, defaults *submissionFields) (*submissionFields, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, usageErrorf("--interactive needs a terminal to ask questions on")
+	}
+
+	fields := &submissionFields{}
+	var err error
+
+	err = survey.AskOne(&survey.Input{Message: "Username:", Default: defaults.Username}, &fields.Username,
+		survey.WithValidator(func(answer interface{}) error {
+			_, err := filterSubmittedUsername(answer.(string))
+			return err
+		}))
+	if err != nil {
+		return nil, err
+	}
+	fields.Username, _ = filterSubmittedUsername(fields.Username)
+
+	err = survey.AskOne(&survey.Select{Message: "Service:", Options: validServices, Default: defaultOption(validServices, defaults.Service)}, &fields.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	err = survey.AskOne(&survey.Select{Message: "Type:", Options: validExceptionTypes, Default: defaultOption(validExceptionTypes, defaults.Type)}, &fields.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	fields.Detail, err = askForDetail(fields.Type, defaults.Detail)
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything dates.go understands is fine, but it gets turned into
+	//  YYYY-MM-DD straight away, so the preview shows the actual dates
+	defaultEnds := defaults.Ends
+	if defaultEnds == "" {
+		aYearFromToday := dates.today.AddDate(1, 0, 0)
+		defaultEnds = stringFromDate(&aYearFromToday)
+	}
+	for _, v := range []struct {
+		question     string
+		answer       *string
+		defaultValue string
+	}{
+		{"Submitted on:", &fields.Submitted, defaults.Submitted},
+		{"Starts on:", &fields.Starts, defaults.Starts},
+		{"Ends on (or e.g. +6m after it starts):", &fields.Ends, defaultEnds},
+	} {
+		isEnd := v.answer == &fields.Ends
+		parse := func(text string) (time.Time, error) {
+			if isEnd {
+				startDate, _ := time.Parse(dateLayout, fields.Starts)
+				return dates.parseEndDate(text, startDate)
+			}
+			return dates.parse(text)
+		}
+		err = survey.AskOne(&survey.Input{Message: v.question, Default: v.defaultValue}, v.answer,
+			survey.WithValidator(func(answer interface{}) error {
+				_, err := parse(answer.(string))
+				return err
+			}))
+		if err != nil {
+			return nil, err
+		}
+		date, _ := parse(*v.answer)
+		*v.answer = stringFromDate(&date)
+	}
+	return fields, nil
+}
+
+// Quotas are the most common sort of exception by far, and their details
+// are always a size and where it's for, so those get asked for separately
+// and tidied up. Anything else is free text.
+func askForDetail(exceptionType string, defaultDetail string) (string, error) {
+	// e.g. "5TB Scratch", which is what --detail defaults to
+	defaultSize, defaultLocation := "", "Scratch"
+	parts := strings.SplitN(defaultDetail, " ", 2)
+	isQuotaDetail := len(parts) == 2 && ValidateStorageSpec(parts[0]) == nil
+	if isQuotaDetail {
+		defaultSize, defaultLocation = parts[0], parts[1]
+	}
+
+	if exceptionType != "quota" {
+		// A quota-looking detail is most likely just --detail's default,
+		//  which would be no use as anything else's
+		if isQuotaDetail {
+			defaultDetail = ""
+		}
+		var detail string
+		err := survey.AskOne(&survey.Input{Message: "Detail (queue length, what access, etc):", Default: defaultDetail}, &detail, survey.WithValidator(survey.Required))
+		return detail, err
+	}
+
+	var size, location string
+	err := survey.AskOne(&survey.Input{Message: "Quota size (e.g. 5TB):", Default: defaultSize}, &size,
+		survey.WithValidator(func(answer interface{}) error {
+			if ValidateStorageSpec(answer) != nil {
+				return errors.New("should be a size like 500GB, 5TB or 2TiB")
+			}
+			return nil
+		}))
+	if err != nil {
+		return "", err
+	}
+	size, _ = TidyStorageSpec(size)
+
+	err = survey.AskOne(&survey.Input{Message: "Quota for (e.g. Scratch, Home):", Default: defaultLocation}, &location, survey.WithValidator(survey.Required))
+	if err != nil {
+		return "", err
+	}
+	return size + " " + location, nil
+}
+
+// Select won't accept a default that isn't one of its options.
+func defaultOption(options []string, value string) interface{} {
+	value = strings.ToLower(value)
+	for _, v := range options {
+		if v == value {
+			return v
+		}
+	}
+	return nil
+}
+
+// After the exception itself has been confirmed: an optional comment, from
+// the editor, and an optional form to attach. Giving up on the comment in
+// the editor just means there isn't one.
+func askForCommentAndForm(fields *submissionFields) (string, string, error) {
+	addComment := false
+	err := survey.AskOne(&survey.Confirm{Message: "Add a comment?"}, &addComment)
+	if err != nil {
+		return "", "", err
+	}
+	commentText := ""
+	if addComment {
+		commentText, err = getTextFromEditor("", fields.commentEditorSummary())
+		if errors.Is(err, errNothingWritten) {
+			log.Print("No comment added.")
+		} else if err != nil {
+			return "", "", err
+		}
+	}
+
+	formFilename := ""
+	err = survey.AskOne(&survey.Input{Message: "Form to attach (leave empty for none):"}, &formFilename,
+		survey.WithValidator(func(answer interface{}) error {
+			if answer.(string) == "" {
+				return nil
+			}
+			info, err := os.Stat(answer.(string))
+			if err == nil && info.IsDir() {
+				return errors.New("that's a directory")
+			}
+			return err
+		}))
+	if err != nil {
+		return "", "", err
+	}
+	return commentText, formFilename, nil
+}
@@ -9,144 +9,768 @@ function pr() {
 
 echo "travis_fold:start:Setting up config"
 
-TRAVIS_MYSQL_PORT="$(grep -e '^port =' "$HOME/.my.cnf" | sed -e 's/port = //')"
-
 # The location of the binary is somewhere in /tmp after running install.sh
 #  but we don't know where, since it's a mktemp directory.
-EXE="$(find /tmp/tmp.* -name "exceptions")"
+EXE="${EXE:-$(find /tmp/tmp.* -name "exceptions")}"
+
+tmpdir="$(mktemp -d)"
 
-cat >"$HOME/.exceptions_db.conf" <<EOF
+# The tests are run once for each database we can get at:
+#  SQLite always, MySQL if there's a ~/.my.cnf (as on Travis), and
+#  PostgreSQL if psql can connect using the usual PG* environment variables.
+configs=()
+
+cat >"$tmpdir/sqlite3.conf" <<EOF
+{
+    "db_type": "sqlite3",
+    "db_connection_string": "$tmpdir/service_exceptions_test.db"
+}
+EOF
+configs+=("$tmpdir/sqlite3.conf")
+
+if [[ -f "$HOME/.my.cnf" ]]; then
+  TRAVIS_MYSQL_PORT="$(grep -e '^port =' "$HOME/.my.cnf" | sed -e 's/port = //')"
+  cat >"$tmpdir/mysql.conf" <<EOF
 {
     "db_type": "mysql",
     "db_connection_string": "travis:@tcp(127.0.0.1:$TRAVIS_MYSQL_PORT)/service_exceptions_test"
 }
 EOF
+  configs+=("$tmpdir/mysql.conf")
+fi
+
+if which psql >/dev/null 2>&1 && psql -c 'SELECT 1' >/dev/null 2>&1; then
+  psql -c 'CREATE DATABASE service_exceptions_test' >/dev/null 2>&1 || true
+  cat >"$tmpdir/postgres.conf" <<EOF
+{
+    "db_type": "postgres",
+    "db_connection_string": "host=${PGHOST:-127.0.0.1} port=${PGPORT:-5432} user=${PGUSER:-postgres} dbname=service_exceptions_test sslmode=disable"
+}
+EOF
+  configs+=("$tmpdir/postgres.conf")
+fi
 
 echo "travis_fold:start:test_setup"
 
-tmpdir="$(mktemp -d)"
-
-echo "travis_fold:start:test_running"
-set -o errexit
-pb "Running tests..."
-pb "Creating database schema..."
-"$EXE" createdb
-pb "Creating blank dump for comparison..."
-"$EXE" dumpjson >"$tmpdir/dump-blank.json"
-pb "Destroying database schema..."
-"$EXE" destroydb
-pb "Recreating database schema for rest of tests..."
-"$EXE" createdb
-pb "Submitting several entries..."
-# One for each cluster
-"$EXE" submit --username="someone" --service="myriad"
-"$EXE" submit --username="someone" --service="legion"
-"$EXE" submit --username="someone" --service="grace"
-"$EXE" submit --username="someone" --service="kathleen"
-"$EXE" submit --username="someone" --service="thomas"
-"$EXE" submit --username="someone" --service="michael"
-pb "Submitting an invalid entry (invalid clustername)..."
-if "$EXE" submit --username="someone" --service="XXXXXXX"; then
-  pr "Entry should have failed, instead succeeded."
-  false
-fi
-echo "travis_fold:start:listing_dumps"
-pb "Listing..."
-"$EXE" list
-pb "Printing dump..."
-"$EXE" dumpjson
-echo "travis_fold:end:listing_dumps"
-pb "Testing dump and re-import..."
-"$EXE" dumpjson >"$tmpdir/dump-before.json"
-"$EXE" list >"$tmpdir/dump-before.list"
-pb "  Destroying and recreating db..."
-"$EXE" destroydb
-"$EXE" createdb
-pb "  Checking fresh blank dump matches old one..."
-"$EXE" dumpjson >"$tmpdir/dump-blank-2.json"
-if ! diff -q "$tmpdir/dump-blank.json" "$tmpdir/dump-blank-2.json"; then
-  pr "blank dumps before and after should be the same, were different."
-  pr "Full diff:"
-  diff "$tmpdir/dump-blank.json" "$tmpdir/dump-blank-2.json"
-fi
-pb "  Reimporting dump..."
-"$EXE" importjson <"$tmpdir/dump-before.json"
-"$EXE" list >"$tmpdir/dump-after.list"
-"$EXE" dumpjson >"$tmpdir/dump-after.json"
-pb "  Comparing before and after data..."
-if ! diff -q "$tmpdir/dump-before.json" "$tmpdir/dump-after.json"; then
-  pr "dumps before and after should be the same, were different."
-  pr "Full diff:"
-  diff "$tmpdir/dump-before.json" "$tmpdir/dump-after.json"
-fi
-if ! diff -q "$tmpdir/dump-before.list" "$tmpdir/dump-after.list"; then
-  pr "listings before and after should be the same, were different."
-  pr "Full diff:"
-  diff "$tmpdir/dump-before.list" "$tmpdir/dump-after.list"
-fi
-pb "  Submitting new entry to create different dump..."
-"$EXE" submit --username="someone" --service="michael"
-"$EXE" dumpjson >"$tmpdir/dump-after-different.json"
-"$EXE" list >"$tmpdir/dump-after-different.list"
-if diff -q "$tmpdir/dump-before.json" "$tmpdir/dump-after-different.json" >/dev/null; then
-  pr "dumps before and after submitting new exception should be different, instead were the same."
-  false
-fi
-if diff -q "$tmpdir/dump-before.list" "$tmpdir/dump-after-different.list" >/dev/null; then
-  pr "listings before and after submitting new exception should be different, instead were the same."
-  false
-fi
+function run_tests() {
+  echo "travis_fold:start:test_running"
+  # Dumps record when they were made, which obviously differs between them
+  function dump() {
+    "$EXE" dumpjson "$@" | grep -v '"dumped_at"'
+  }
+  pb "Running tests..."
+  pb "Creating database schema..."
+  "$EXE" createdb
+  pb "Creating blank dump for comparison..."
+  dump >"$tmpdir/dump-blank.json"
+  pb "Destroying database schema..."
+  "$EXE" destroydb
+  pb "Recreating database schema for rest of tests..."
+  "$EXE" createdb
+  pb "Submitting several entries..."
+  # One for each cluster
+  "$EXE" submit --username="someone" --service="myriad"
+  "$EXE" submit --username="someone" --service="legion"
+  "$EXE" submit --username="someone" --service="grace"
+  "$EXE" submit --username="someone" --service="kathleen"
+  "$EXE" submit --username="someone" --service="thomas"
+  "$EXE" submit --username="someone" --service="michael"
+  pb "Submitting an invalid entry (invalid clustername)..."
+  if "$EXE" submit --username="someone" --service="XXXXXXX"; then
+    pr "Entry should have failed, instead succeeded."
+    false
+  fi
+  echo "travis_fold:start:listing_dumps"
+  pb "Listing..."
+  "$EXE" list
+  pb "Printing dump..."
+  "$EXE" dumpjson
+  echo "travis_fold:end:listing_dumps"
+  pb "Testing dump and re-import..."
+  dump >"$tmpdir/dump-before.json"
+  "$EXE" list >"$tmpdir/dump-before.list"
+  pb "  Destroying and recreating db..."
+  "$EXE" destroydb
+  "$EXE" createdb
+  pb "  Checking fresh blank dump matches old one..."
+  dump >"$tmpdir/dump-blank-2.json"
+  if ! diff -q "$tmpdir/dump-blank.json" "$tmpdir/dump-blank-2.json"; then
+    pr "blank dumps before and after should be the same, were different."
+    pr "Full diff:"
+    diff "$tmpdir/dump-blank.json" "$tmpdir/dump-blank-2.json"
+  fi
+  pb "  Reimporting dump..."
+  "$EXE" importjson <"$tmpdir/dump-before.json"
+  "$EXE" list >"$tmpdir/dump-after.list"
+  dump >"$tmpdir/dump-after.json"
+  pb "  Comparing before and after data..."
+  if ! diff -q "$tmpdir/dump-before.json" "$tmpdir/dump-after.json"; then
+    pr "dumps before and after should be the same, were different."
+    pr "Full diff:"
+    diff "$tmpdir/dump-before.json" "$tmpdir/dump-after.json"
+  fi
+  if ! diff -q "$tmpdir/dump-before.list" "$tmpdir/dump-after.list"; then
+    pr "listings before and after should be the same, were different."
+    pr "Full diff:"
+    diff "$tmpdir/dump-before.list" "$tmpdir/dump-after.list"
+  fi
+  pb "  Submitting new entry to create different dump..."
+  "$EXE" submit --username="someone" --service="michael" --allow-overlap
+  dump >"$tmpdir/dump-after-different.json"
+  "$EXE" list >"$tmpdir/dump-after-different.list"
+  if diff -q "$tmpdir/dump-before.json" "$tmpdir/dump-after-different.json" >/dev/null; then
+    pr "dumps before and after submitting new exception should be different, instead were the same."
+    false
+  fi
+  if diff -q "$tmpdir/dump-before.list" "$tmpdir/dump-after-different.list" >/dev/null; then
+    pr "listings before and after submitting new exception should be different, instead were the same."
+    false
+  fi
+  pb "  Checking a dry run of the old dump would change nothing..."
+  dryrun="$("$EXE" importjson --dry-run <"$tmpdir/dump-before.json")"
+  if [[ "$dryrun" != "Would create 0, update 0, skip 0 and leave 6 unchanged." ]]; then
+    pr "dry run of re-import should have changed nothing, instead got:"
+    pr "$dryrun"
+    false
+  fi
+  pb "  Re-importing the old dump, gzipped, over the new data..."
+  gzip -c "$tmpdir/dump-before.json" | "$EXE" importjson
+  dump >"$tmpdir/dump-after-merge.json"
+  if ! diff -q "$tmpdir/dump-after-different.json" "$tmpdir/dump-after-merge.json"; then
+    pr "merging in a dump that's already there should change nothing, but did."
+    diff "$tmpdir/dump-after-different.json" "$tmpdir/dump-after-merge.json"
+    false
+  fi
+  pb "  Re-importing the old dump, as an old-style bare array, replacing the new data..."
+  { echo "["; sed -e '1,/"exceptions": \[/d' "$tmpdir/dump-before.json" | sed -e '$d' | sed -e '$d'; echo "]"; } \
+    | "$EXE" importjson --mode=replace
+  dump >"$tmpdir/dump-after-replace.json"
+  if ! diff -q "$tmpdir/dump-before.json" "$tmpdir/dump-after-replace.json"; then
+    pr "replacing everything with the old dump should get back the old dump, but didn't."
+    diff "$tmpdir/dump-before.json" "$tmpdir/dump-after-replace.json"
+    false
+  fi
+  pb "  Checking importing a changed dump twice only changes anything the first time..."
+  sed -e '0,/"ExceptionDetail": ""/s//"ExceptionDetail": "changed"/' "$tmpdir/dump-before.json" >"$tmpdir/dump-changed.json"
+  "$EXE" importjson <"$tmpdir/dump-changed.json"
+  dryrun="$("$EXE" importjson --dry-run <"$tmpdir/dump-changed.json")"
+  if [[ "$dryrun" != "Would create 0, update 0, skip 0 and leave 6 unchanged." ]]; then
+    pr "importing a dump that's already been imported should change nothing, instead got:"
+    pr "$dryrun"
+    false
+  fi
+  "$EXE" importjson --mode=replace <"$tmpdir/dump-before.json"
+  pb "  Appending the old dump as new exceptions..."
+  "$EXE" importjson --mode=append <"$tmpdir/dump-before.json"
+  if [[ "$("$EXE" list | grep -c someone)" != 12 ]]; then
+    pr "appending should have made 12 exceptions, but didn't."
+    false
+  fi
+  pb "  Checking a dump from a newer schema is refused..."
+  if sed -e 's/"schema_version": [0-9]*/"schema_version": 999/' "$tmpdir/dump-before.json" | "$EXE" importjson; then
+    pr "import of a dump with a newer schema should have failed, instead succeeded."
+    false
+  fi
 
 
-# Okay, those were kind of simple.
-# Now to test a workflow.
-pb "Testing a sample workflow..."
-function getprop() {
-  grep "^ *$1 *|" \
-    | sed -e 's/^[^|]*| //' \
-          -e 's/ *$//' \
-          -e 's/^ *//'
-}
-function checkprop() {
-  local prop
-  prop="$(
-    "$EXE" info "$1" \
-      | getprop "$2" \
+  # Okay, those were kind of simple.
+  # Now to test a workflow.
+  pb "Testing a sample workflow..."
+  function getprop() {
+    grep "^ *$1 *|" \
+      | sed -e 's/^[^|]*| //' \
+            -e 's/ *$//' \
+            -e 's/^ *//'
+  }
+  function checkprop() {
+    local prop
+    prop="$(
+      "$EXE" info "$1" \
+        | getprop "$2" \
     )"
-  if [[ "$prop" != "$3" ]]; then
-    echo "Failed: check for $2 in entry $1: expected \"$3\", got \"$prop\""
-    return 1
+    if [[ "$prop" != "$3" ]]; then
+      echo "Failed: check for $2 in entry $1: expected \"$3\", got \"$prop\""
+      return 1
+    fi
+  }
+
+  "$EXE" destroydb
+  "$EXE" createdb
+  echo "TEST FILE" >"$tmpdir/test_file"
+  echo " Submitting..."
+  "$EXE" submit --username=BEEP123 --service=none --comment="ABCDEF" --type=special --submitted=2026-01-15 --starts=2030-01-31 --ends=2030-04-04 --form="$tmpdir/test_file"
+  echo " Checking username..."; checkprop 1 "Username"  "beep123" # Usernames should force lowercase
+  echo " Checking dates...";    checkprop 1 "Submitted" "2026-01-15"
+                                checkprop 1 "Starts"    "2030-01-31" 
+                                checkprop 1 "Ends"      "2030-04-04"
+  echo " Checking service...";  checkprop 1 "Service"   "none"
+  echo " Checking type...";     checkprop 1 "Type"      "special"
+  echo " Checking status...";   checkprop 1 "Status"    "undecided"
+  echo " Marking as approved..."
+  "$EXE" approve 1
+  echo " Marking as implemented..."
+  "$EXE" implemented 1
+  echo " Checking status updates..."
+  [[ "$("$EXE" info 1 | grep -c "Status Change")" == "3" ]]
+  [[ $("$EXE" info 1 | getprop "Status") == "implemented" ]]
+  echo " Adding comment..."
+  "$EXE" comment -c "MNOPQ" 1
+  echo " Marking as removed..."
+  "$EXE" remove 1
+  echo " Checking status updates..."
+  [[ "$("$EXE" info 1 | grep -c "Status Change")" == "4" ]]
+  [[ $("$EXE" info 1 | getprop "Status") == "removed" ]]
+  echo " Checking exit codes..."
+  function checkexit() {
+    local expected="$1" actual=0
+    shift
+    "$EXE" "$@" >/dev/null 2>&1 || actual="$?"
+    if [[ "$actual" != "$expected" ]]; then
+      pr "Failed: exit code of \"$*\": expected $expected, got $actual"
+      return 1
+    fi
+  }
+  checkexit 2 nosuchcommand
+  checkexit 4 info 999
+  checkexit 5 approve 1
+  checkexit 6 submit --username=toolongusername
+  checkexit 3 --config=/nonexistent/config list
+  echo " Checking a failed submission leaves nothing behind..."
+  before="$("$EXE" list all | wc -l)"
+  checkexit 6 submit --username=beep123 --comment="half-done" --form="$tmpdir/no_such_file"
+  after="$("$EXE" list all | wc -l)"
+  [[ "$before" == "$after" ]] || { pr "Failed: a failed submit still created an exception"; false; }
+  echo " Checking comment replies, edits and deletion..."
+  "$EXE" comment reply 2 -c "RSTUV" # Comment 3
+  printf '#!/bin/bash\nsed -i -e "s/ABCDEF/ABCDEF, edited/" "$1"\n' >"$tmpdir/fake_editor"
+  chmod +x "$tmpdir/fake_editor"
+  EDITOR="$tmpdir/fake_editor" "$EXE" comment edit 1 # Keeps the old version as comment 4
+  checkexit 6 comment edit 1 -c "ABCDEF, edited"
+  checkexit 6 comment edit 4 -c "Editing history"
+  checkexit 4 comment edit 999 -c "No such comment"
+  EDITOR=true checkexit 6 comment edit 1 # Left unchanged
+  EDITOR=true checkexit 6 comment reply 1 # Left empty
+  "$EXE" comment list 1 | grep -q "Lines starting" && { pr "Failed: the editor's template should not end up in comments"; false; }
+  "$EXE" info 1 | grep -q "#1 by $(whoami) \[.*, edited\]" || { pr "Failed: details should show who wrote comment 1, and that it was edited"; false; }
+  "$EXE" info 1 | grep -q "^ *|   #3 by $(whoami)" || { pr "Failed: details should show comment 3 as a reply"; false; }
+  [[ "$("$EXE" comment list 1 | grep -c "ABCDEF")" == 1 ]] || { pr "Failed: comment list should only show the current version of comment 1"; false; }
+  "$EXE" comment list 1 --history | grep -q "^ *4 |.*| ABCDEF *| *1 *$" || { pr "Failed: comment list --history should show the old version of comment 1"; false; }
+  "$EXE" comment delete 3
+  "$EXE" info 1 | grep -q "RSTUV" && { pr "Failed: a deleted comment should not be shown"; false; }
+  [[ "$("$EXE" list all | awk -F'|' '$1 ~ /^ *1 *$/ { gsub(/ /, "", $11); print $11 }')" == 2 ]] || { pr "Failed: list should count only current comments"; false; }
+  echo " Checking importing can't move comments etc from one exception to another..."
+  "$EXE" dumpjson --ids=1 | sed -e '0,/"ID": 1,/s//"ID": 999,/' >"$tmpdir/clashing_dump.json"
+  "$EXE" importjson --dry-run <"$tmpdir/clashing_dump.json" 2>/dev/null | grep -q "^ *comment 1 already belongs to exception 1$" \
+    || { pr "Failed: a dry run should show that exception 999's comment 1 belongs to exception 1"; false; }
+  checkexit 6 importjson <"$tmpdir/clashing_dump.json"
+  checkexit 4 info 999
+  [[ "$("$EXE" comment list 1 | grep -c "ABCDEF")" == 1 ]] || { pr "Failed: a refused import should have left comment 1 on exception 1"; false; }
+  echo " Checking comments are rendered from Markdown..."
+  "$EXE" comment 1 -c "# Why **this** is needed
+
+The group is running a *large* ensemble of simulations, which produces far more output than the default quota allows.
+
+- move the old runs to the archive, which will take a while because there are a lot of them
+- delete anything in \`/scratch/tmp\` for user_name
+
+\`\`\`
+du -sh  /scratch
+\`\`\`"
+  VISUAL="sed -i -e '1s/^/Written in an editor/'" EDITOR=false "$EXE" comment 1
+  "$EXE" info 1 >"$tmpdir/markdown_details"
+  grep -q "^ *| Written in an editor *$" "$tmpdir/markdown_details" || { pr "Failed: \$VISUAL should be used, with its options"; false; }
+  grep -q "^ *| Why this is needed *$" "$tmpdir/markdown_details" || { pr "Failed: headings should be shown without the markup"; false; }
+  grep -q "^ *| The group is running a large ensemble of simulations, which produces far more *$" "$tmpdir/markdown_details" || { pr "Failed: paragraphs should be wrapped to 80 characters"; false; }
+  grep -q "^ *|   lot of them *$" "$tmpdir/markdown_details" || { pr "Failed: list items should be wrapped with a hanging indent"; false; }
+  grep -q "^ *| - delete anything in /scratch/tmp for user_name *$" "$tmpdir/markdown_details" || { pr "Failed: code and underscores should be shown as written"; false; }
+  grep -q "^ *|     du -sh  /scratch *$" "$tmpdir/markdown_details" || { pr "Failed: code blocks should be indented and left alone"; false; }
+  grep -q $'\e' "$tmpdir/markdown_details" && { pr "Failed: details should not use ANSI codes when not on a terminal"; false; }
+  echo " Checking form attachment..."
+  "$EXE" form download-for 1
+  diff -q "test_file" "$tmpdir/test_file"
+  rm -f "test_file"
+  "$EXE" form verify 1
+  checkexit 6 form attach 1 "$tmpdir/test_file" # It's a duplicate
+  echo " Checking download options..."
+  rm -rf "$tmpdir/downloads"
+  mkdir "$tmpdir/downloads"
+  "$EXE" form download --stdout 1 | diff -q - "$tmpdir/test_file"
+  "$EXE" form download -o "$tmpdir/downloads" 1
+  "$EXE" form download -o "$tmpdir/downloads" 1
+  "$EXE" form download -o "$tmpdir/downloads" --overwrite 1
+  if [[ "$(ls "$tmpdir/downloads" | xargs -d '\n')" != "test_file test_file (1)" ]]; then
+    pr "Failed: second download should have been named \"test_file (1)\", and the third should have overwritten the first"
+    false
+  fi
+  [[ "$(stat -c %a "$tmpdir/downloads/test_file")" == 600 ]] || { pr "Failed: downloaded files should be mode 600"; false; }
+  "$EXE" form download-for --zip -o "$tmpdir/downloads" 1
+  unzip -p "$tmpdir/downloads/exception-1.zip" test_file | diff -q - "$tmpdir/test_file"
+  checkexit 6 form download -o "$tmpdir/no_such_dir" 1
+  # Filenames come from whoever attached the file, so nothing should be able to escape the output directory
+  "$EXE" dumpjson | sed -e 's|"FileName": "test_file"|"FileName": "../../escaped"|' | "$EXE" importjson
+  "$EXE" form download -o "$tmpdir/downloads" 1
+  [[ -f "$tmpdir/downloads/_.._escaped" ]] || { pr "Failed: a filename with slashes in should have been made safe"; false; }
+  "$EXE" dumpjson | sed -e 's|"FileName": "../../escaped"|"FileName": "test_file"|' | "$EXE" importjson
+  rm -rf "$tmpdir/downloads"
+  echo " Checking partial dumps..."
+  if [[ "$("$EXE" dumpjson --no-files | grep -c '"FileContents": null')" != 1 ]]; then
+    pr "Failed: dump without files should have left out exactly one file"
+    false
+  fi
+  "$EXE" dumpjson --no-files | "$EXE" importjson
+  if [[ "$("$EXE" dumpjson --no-files | "$EXE" importjson --dry-run)" != "Would create 0, update 0, skip 0 and leave 1 unchanged." ]]; then
+    pr "Failed: dump without files should import over the same data without changing it"
+    false
+  fi
+  "$EXE" form download-for 1
+  diff -q "test_file" "$tmpdir/test_file"
+  rm -f "test_file"
+  if [[ "$("$EXE" dumpjson --ids=1 | grep -c '"Username"')" != 1 ]] \
+    || [[ "$("$EXE" dumpjson --since=tomorrow | grep -c '"Username"')" != 0 ]] \
+    || [[ "$("$EXE" dumpjson --since="$(date +%Y-%m-%d)" | grep -c '"Username"')" != 1 ]] \
+    || [[ "$("$EXE" dumpjson --since=-1w | grep -c '"Username"')" != 1 ]] \
+    || [[ "$("$EXE" dumpjson --since=-1w | grep -c "\"since\": \"$(date -d '-1 week' +%Y-%m-%d)\"")" != 1 ]]; then
+    pr "Failed: dumps of selected exceptions had the wrong exceptions in"
+    false
+  fi
+  if "$EXE" dumpjson --ids=1 | "$EXE" importjson --mode=replace; then
+    pr "Failed: replacing everything with a partial dump should have been refused"
+    false
+  fi
+  echo " Checking backup and restore..."
+  "$EXE" backup "$tmpdir/backup.tar.gz"
+  "$EXE" --config=/nonexistent backup verify "$tmpdir/backup.tar.gz"
+  head -c 200 "$tmpdir/backup.tar.gz" >"$tmpdir/backup-truncated.tar.gz"
+  checkexit 8 backup verify "$tmpdir/backup-truncated.tar.gz"
+  checkexit 6 restore "$tmpdir/backup.tar.gz" # The DB isn't empty
+  dump >"$tmpdir/dump-before-restore.json"
+  "$EXE" destroydb
+  "$EXE" createdb
+  "$EXE" restore "$tmpdir/backup.tar.gz"
+  dump >"$tmpdir/dump-after-restore.json"
+  if ! diff -q "$tmpdir/dump-before-restore.json" "$tmpdir/dump-after-restore.json"; then
+    pr "Failed: dumps before backing up and after restoring should be the same, were different."
+    diff "$tmpdir/dump-before-restore.json" "$tmpdir/dump-after-restore.json"
+    false
+  fi
+  # Comment 3 has been deleted, but could still be recovered
+  tar -xzOf "$tmpdir/backup.tar.gz" exceptions.json | grep -q "RSTUV" \
+    || { pr "Failed: backups should include soft-deleted comments"; false; }
+  "$EXE" backup "$tmpdir/backup-2.tar.gz"
+  if ! diff -q <(tar -xzOf "$tmpdir/backup.tar.gz" exceptions.json | grep -v '"dumped_at"') \
+               <(tar -xzOf "$tmpdir/backup-2.tar.gz" exceptions.json | grep -v '"dumped_at"'); then
+    pr "Failed: backing up a restored backup should give the same backup, including anything soft-deleted"
+    false
+  fi
+  echo " Checking file types, compression and size limits..."
+  mkdir -p "$tmpdir/compressible"
+  seq 1 5000 >"$tmpdir/compressible/numbers.txt"
+  "$EXE" form attach 1 "$tmpdir/compressible/numbers.txt"
+  "$EXE" form list 1 | grep numbers.txt | grep -q "text/plain" || { pr "Failed: form list should show numbers.txt as text/plain"; false; }
+  "$EXE" form list 1 | grep numbers.txt | grep -q "zstd" || { pr "Failed: numbers.txt should have been stored compressed"; false; }
+  "$EXE" form verify 1
+  "$EXE" form download-for 1
+  diff -q "numbers.txt" "$tmpdir/compressible/numbers.txt"
+  rm -f "numbers.txt" "test_file"
+  truncate -s 16M "$tmpdir/too_big"
+  checkexit 6 form attach 1 "$tmpdir/too_big"
+  rm -f "$tmpdir/too_big"
+
+  pb "Testing attachment stores..."
+  # Makes a copy of the current config with some extra settings
+  function withsettings() {
+    sed -e "s|^{|{\n    $2,|" "$EXCEPTIONS_CONFIG" >"$tmpdir/$1.conf"
+  }
+  # Moves everything into a store and back again, checking nothing changes
+  function checkstore() {
+    local config="$tmpdir/$1.conf" store="$2"
+    dump --config="$config" >"$tmpdir/dump-before-migrating.json"
+    "$EXE" --config="$config" form migrate-storage
+    if [[ "$("$EXE" --config="$config" form list 1 | grep -c "| $store")" != 2 ]]; then
+      pr "Failed: both files should have been moved to $store storage"
+      false
+    fi
+    "$EXE" --config="$config" form verify
+    "$EXE" --config="$config" form download-for 1
+    diff -q "numbers.txt" "$tmpdir/compressible/numbers.txt"
+    rm -f "numbers.txt" "test_file"
+    dump --config="$config" >"$tmpdir/dump-after-migrating.json"
+    if ! diff -q "$tmpdir/dump-before-migrating.json" "$tmpdir/dump-after-migrating.json"; then
+      pr "Failed: moving files to $store storage should not change dumps"
+      false
+    fi
+    checkexit 8 form verify 1 # The normal config doesn't say where they are
+    "$EXE" --config="$config" form migrate-storage --to=database
+    "$EXE" form verify
+  }
+  rm -rf "$tmpdir/store"
+  withsettings directory "\"attachment_store\": \"directory\", \"attachment_directory\": \"$tmpdir/store\""
+  checkstore directory directory
+  if [[ "$(find "$tmpdir/store" -type f | wc -l)" != 0 ]]; then
+    pr "Failed: moving files back to the database should have emptied the attachment directory"
+    false
+  fi
+
+  if which python3 >/dev/null 2>&1; then
+    # Just enough of S3 to store and fetch objects, checking they're signed
+    cat >"$tmpdir/s3_standin.py" <<'EOF'
+import http.server, sys
+objects = {}
+class Handler(http.server.BaseHTTPRequestHandler):
+    def log_message(self, *args):
+        pass
+    def reply(self, code, body=b""):
+        self.send_response(code)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+    def signed(self):
+        if not self.headers.get("Authorization", "").startswith("AWS4-HMAC-SHA256 Credential=test/"):
+            self.reply(403)
+            return False
+        return True
+    def do_PUT(self):
+        if self.signed():
+            objects[self.path] = self.rfile.read(int(self.headers["Content-Length"]))
+            self.reply(200)
+    def do_GET(self):
+        if self.signed():
+            if self.path in objects:
+                self.reply(200, objects[self.path])
+            else:
+                self.reply(404)
+    def do_DELETE(self):
+        if self.signed():
+            objects.pop(self.path, None)
+            self.reply(204)
+server = http.server.HTTPServer(("127.0.0.1", 0), Handler)
+with open(sys.argv[1], "w") as f:
+    f.write(str(server.server_port))
+server.serve_forever()
+EOF
+    rm -f "$tmpdir/s3_port"
+    python3 "$tmpdir/s3_standin.py" "$tmpdir/s3_port" &
+    s3_pid=$!
+    while [[ ! -s "$tmpdir/s3_port" ]]; do sleep 0.1; done
+    withsettings s3 "\"attachment_store\": \"s3\", \"s3\": {\"endpoint\": \"http://127.0.0.1:$(cat "$tmpdir/s3_port")\", \"bucket\": \"forms\", \"access_key\": \"test\", \"secret_key\": \"secret\"}"
+    checkstore s3 s3
+    kill "$s3_pid"
+  fi
+
+  pb "Testing removing, replacing and describing files..."
+  echo "RENEWAL FORM" >"$tmpdir/renewal_form"
+  "$EXE" form attach --description="renewal form" 1 "$tmpdir/renewal_form" # File 3
+  "$EXE" form list 1 | grep renewal_form | grep -q "renewal form" || { pr "Failed: form list should show the file's description"; false; }
+  echo "RENEWAL FORM, CORRECTED" >"$tmpdir/renewal_form"
+  "$EXE" form replace 3 "$tmpdir/renewal_form" # File 4
+  if [[ "$("$EXE" form list 1 | grep -c renewal_form)" != 1 ]] \
+    || [[ "$("$EXE" form list --history 1 | grep -c renewal_form)" != 2 ]]; then
+    pr "Failed: form list should only show the old version of a replaced file with --history"
+    false
+  fi
+  "$EXE" form list 1 | grep renewal_form | grep -q "renewal form" || { pr "Failed: a replacement file should keep the description"; false; }
+  [[ "$("$EXE" form download --stdout 3)" == "RENEWAL FORM" ]] || { pr "Failed: the old version of a replaced file should still be there"; false; }
+  checkexit 6 form replace 3 "$tmpdir/renewal_form" # It's already been replaced
+  "$EXE" form remove 2
+  [[ "$("$EXE" form list 1 | grep -c numbers.txt)" == 0 ]] || { pr "Failed: a removed file should not be listed"; false; }
+  checkexit 4 form download 2
+  if [[ "$("$EXE" info 1 | grep -c -e "replace file: replaced file 3" -e "remove file: removed file 2")" != 2 ]]; then
+    pr "Failed: removing and replacing files should have been audited"
+    false
   fi
+  [[ "$("$EXE" list all | awk -F'|' '$1 ~ /^ *1 *$/ { gsub(/ /, "", $10); print $10 }')" == 2 ]] || { pr "Failed: list should count only current, not removed or replaced, files"; false; }
+  if [[ "$("$EXE" dumpjson | "$EXE" importjson --dry-run)" != "Would create 0, update 0, skip 0 and leave 1 unchanged." ]]; then
+    pr "Failed: a dump with replaced files in should import over the same data without changing it"
+    false
+  fi
+
+  pb "Testing submitting from forms..."
+  "$EXE" form template \
+    | sed -e 's/^username:$/username: ZZZZZZ9/' \
+          -e 's/^service:$/service: legion/' \
+          -e 's/^type:$/type: queue/' \
+          -e 's/^detail:$/detail: "10 day jobs"/' \
+          -e 's|^starts:$|starts: 01/02/2026|' \
+          -e 's/^ends:$/ends: 2026-03-01/' \
+    >"$tmpdir/request_form.txt"
+  checkexit 2 submit --from-form="$tmpdir/request_form.txt" # Can't ask for confirmation without a terminal
+  "$EXE" submit --from-form="$tmpdir/request_form.txt" --yes # Exception 2
+  checkexit 6 submit --from-form="$tmpdir/request_form.txt" # Overlaps with exception 2, which is found before asking for confirmation
+  checkprop 2 "Username" "zzzzzz9"
+  checkprop 2 "Service"  "legion"
+  checkprop 2 "Type"     "queue"
+  checkprop 2 "Detail"   "10 day jobs"
+  checkprop 2 "Starts"   "2026-02-01"
+  checkprop 2 "Ends"     "2026-03-01"
+  "$EXE" form list 2 | grep -q request_form.txt || { pr "Failed: submit --from-form should have attached the form"; false; }
+  cat >"$tmpdir/request_email.eml" <<'EOF'
+Date: Thu, 15 Jan 2026 10:00:00 +0000
+From: someone@example.com
+To: rc-support@example.com
+Subject: Re: Exception request
+
+Hi, here's the information you asked for:
+
+> User ID: yyyyyy8
+> Cluster: Grace
+> Type: access
+> Start date: 1st March 2026
+> End date: 31 August 2026
+EOF
+  "$EXE" submit --from-form="$tmpdir/request_email.eml" --yes # Exception 3
+  checkprop 3 "Username"  "yyyyyy8"
+  checkprop 3 "Service"   "grace"
+  checkprop 3 "Submitted" "2026-01-15"
+  checkprop 3 "Starts"    "2026-03-01"
+  checkprop 3 "Ends"      "2026-08-31"
+  echo "Nothing useful in here" >"$tmpdir/not_a_form.txt"
+  checkexit 6 submit --from-form="$tmpdir/not_a_form.txt" --yes
+  checkexit 2 submit --interactive # Can't ask questions without a terminal
+  checkexit 2 submit --interactive --from-form="$tmpdir/request_form.txt"
+
+  pb "Testing list classes and report..."
+  function day() {
+    date -d "$1" +%Y-%m-%d
+  }
+  function listids() {
+    "$EXE" list "$@" \
+      | awk -F'|' '{ gsub(/ /, "", $1) } $1 ~ /^[0-9]+$/ { print $1 }' \
+      | sort -n \
+      | xargs
+  }
+  function checklist() {
+    local ids
+    ids="$(listids "$1")"
+    if [[ "$ids" != "$2" ]]; then
+      pr "Failed: list $1: expected \"$2\", got \"$ids\""
+      return 1
+    fi
+  }
+  function reportids() {
+    "$EXE" report \
+      | awk -v heading="  $1:" '$0 == heading { found=1; next } /^  [^ ]/ { found=0 } found && /^ *- / { print $2 }' \
+      | sort -n \
+      | xargs
+  }
+  function checkreport() {
+    local ids
+    ids="$(reportids "$1")"
+    if [[ "$ids" != "$2" ]]; then
+      pr "Failed: report section \"$1\": expected \"$2\", got \"$ids\""
+      return 1
+    fi
+  }
+
+  "$EXE" destroydb
+  "$EXE" createdb
+  # 1: undecided
+  "$EXE" submit --username=aaaaaa1 --service=grace
+  # 2: approved, not started yet
+  "$EXE" submit --username=aaaaaa2 --starts="$(day "+10 days")" --ends="$(day "+100 days")"
+  "$EXE" approve 2
+  # 3: implemented, should have been removed already
+  "$EXE" submit --username=aaaaaa3 --starts="$(day "-100 days")" --ends="$(day "-1 day")"
+  "$EXE" approve 3; "$EXE" implemented 3
+  # 4: implemented, ends within five days
+  "$EXE" submit --username=aaaaaa4 --starts="$(day "-100 days")" --ends="$(day "+3 days")"
+  "$EXE" approve 4; "$EXE" implemented 4
+  # 5: implemented, ends within two weeks
+  "$EXE" submit --username=aaaaaa5 --starts="$(day "-100 days")" --ends="$(day "+10 days")"
+  "$EXE" approve 5; "$EXE" implemented 5
+  # 6: rejected
+  "$EXE" submit --username=aaaaaa6
+  "$EXE" reject 6
+  # 7: removed
+  "$EXE" submit --username=aaaaaa7 --starts="$(day "-100 days")" --ends="$(day "-50 days")"
+  "$EXE" approve 7; "$EXE" implemented 7; "$EXE" remove 7
+  # 8: ends before it starts
+  checkexit 6 submit --username=aaaaaa8 --starts="$(day "+10 days")" --ends="$(day "-10 days")"
+  "$EXE" submit --username=aaaaaa8 --starts="$(day "+10 days")" --ends="$(day "-10 days")" --force
+
+  checklist all          "1 2 3 4 5 6 7 8"
+  checklist undecided    "1 8"
+  checklist approved     "2"
+  checklist rejected     "6"
+  checklist needed       "2"
+  checklist pending      "2"
+  checklist active       "3 4 5"
+  checklist implemented  "3 4 5"
+  checklist removed      "7"
+  checklist overdue      "3"
+  checklist todo         "1 2 3 8"
+  checklist inconsistent "8"
+  ids="$(listids --service=grace all)"
+  [[ "$ids" == "1" ]] || { pr "Failed: list --service=grace: expected \"1\", got \"$ids\""; false; }
+  ids="$(listids --ends-before=+5d implemented)"
+  [[ "$ids" == "3 4" ]] || { pr "Failed: list --ends-before=+5d implemented: expected \"3 4\", got \"$ids\""; false; }
+  ids="$(listids --starts-after=today --ends-after=+5d all)"
+  [[ "$ids" == "2" ]] || { pr "Failed: list --starts-after=today --ends-after=+5d: expected \"2\", got \"$ids\""; false; }
+  checkexit 6 list --ends-before=sometime
+
+  checkreport "Waiting for Decision"         "1 8"
+  checkreport "Waiting for Implementation"   "2"
+  checkreport "Waiting for Removal"          "3"
+  checkreport "Will Expire Within Five Days" "4"
+  checkreport "Will Expire Within Two Weeks" "5"
+
+  pb "Testing colours..."
+  "$EXE" list | grep -q $'\e' && { pr "Failed: list should not be coloured when not on a terminal"; false; }
+  "$EXE" --color=always list | grep -q $'^ *1 | aaaaaa1 *| \e\\[33mundecided\e\\[0m *|' || { pr "Failed: --color=always should colour undecided exceptions yellow"; false; }
+  "$EXE" --color=always list | grep -q $'^ *3 | aaaaaa3 *| \e\\[31mimplemented\e\\[0m *|' || { pr "Failed: --color=always should colour overdue exceptions red"; false; }
+  "$EXE" --color=always list | grep -q $'^ *4 | aaaaaa4 *| \e\\[32mimplemented\e\\[0m *|' || { pr "Failed: --color=always should colour implemented exceptions green"; false; }
+  "$EXE" --color=always info 3 | grep -q $'^ *Status *| \e\\[31mimplemented\e\\[0m' || { pr "Failed: details should colour the status too"; false; }
+  NO_COLOR=1 script -qec "\"$EXE\" list" /dev/null | grep -q $'\e' && { pr "Failed: NO_COLOR should turn off colour, even on a terminal"; false; }
+  script -qec "\"$EXE\" --color=never examples" /dev/null | grep -q $'\e' && { pr "Failed: --color=never should turn off colour, even on a terminal"; false; }
+  "$EXE" --color=always examples | grep -q $'\e\\[1mStatuses\e\\[0m' || { pr "Failed: examples should be coloured with --color=always"; false; }
+  "$EXE" examples | grep -q '%^' && { pr "Failed: examples should not have colour markers left in"; false; }
+  checkexit 2 --color=sometimes list
+
+  pb "Testing shell completion..."
+  function complete_words() {
+    local COMP_WORDS=("$EXE" "$@") COMP_CWORD="$#" COMPREPLY=()
+    _exceptions_completion
+    echo "${COMPREPLY[@]}"
+  }
+  source <("$EXE" completion bash)
+  [[ "$(complete_words approve "")" == "1 2 3 4 5 6 7 8" ]] || { pr "Failed: exception IDs should be completed, got \"$(complete_words approve "")\""; false; }
+  [[ "$(complete_words submit --username aaaaaa1)" == "aaaaaa1" ]] || { pr "Failed: usernames should be completed from the database"; false; }
+  [[ "$(complete_words list --service "")" == "grace myriad" ]] || { pr "Failed: services should be completed from the database"; false; }
+  [[ "$(complete_words submit --type sh)" == "sharedspace" ]] || { pr "Failed: types should be completed"; false; }
+  [[ "$(complete_words list --se)" == "--service" ]] || { pr "Failed: flags should be completed"; false; }
+  [[ "$(complete_words form re)" == "remove replace" ]] || { pr "Failed: subcommands should be completed"; false; }
+  [[ "$("$EXE" --completion-descriptions --completion-bash details | grep "^1")" == $'1\taaaaaa1: 5TB Scratch quota on grace, undecided' ]] \
+    || { pr "Failed: zsh and fish should get descriptions with exception IDs"; false; }
+  "$EXE" completion zsh | grep -q "^compdef _exceptions exceptions\|^    compdef _exceptions exceptions" || { pr "Failed: completion zsh should print a zsh script"; false; }
+  "$EXE" completion fish | grep -q "^complete -c exceptions" || { pr "Failed: completion fish should print a fish script"; false; }
+  checkexit 2 completion tcsh
+
+  pb "Testing overlap detection..."
+  checklist overlapping ""
+  checkexit 6 submit --username=aaaaaa2 --starts="$(day "+100 days")" --ends="$(day "+200 days")"
+  checklist all "1 2 3 4 5 6 7 8"
+  # 9: overlaps 2 by a day
+  "$EXE" submit --username=aaaaaa2 --starts="$(day "+100 days")" --ends="$(day "+200 days")" --allow-overlap
+  [[ "$("$EXE" info 9 | grep -c "allow overlap")" == "1" ]] || { pr "Failed: --allow-overlap should have been recorded"; false; }
+  # 10: doesn't overlap 2, because it's a different type
+  "$EXE" submit --username=aaaaaa2 --starts="$(day "+10 days")" --ends="$(day "+100 days")" --type=queue --detail="10 day jobs"
+  # 11: doesn't overlap 7, because that's been removed
+  "$EXE" submit --username=aaaaaa7 --starts="$(day "-100 days")" --ends="$(day "-50 days")"
+  checklist overlapping "2 9"
+
+  pb "Testing date validation..."
+  "$EXE" info 8 | grep -q "Submitted with --force, although it starts" || { pr "Failed: --force should have been recorded in a comment"; false; }
+  checkexit 6 submit --username=aaaaaa9 --submitted="$(day "+1 day")"
+  withsettings maxdurations '"max_durations": {"queue": "3 months"}'
+  checkexit 6 --config="$tmpdir/maxdurations.conf" submit --username=aaaaaa9 --type=queue --ends="$(day "+3 months +1 day")"
+  checkexit 0 --config="$tmpdir/maxdurations.conf" submit --username=aaaaaa9 --type=queue --ends="$(day "+3 months")" # 12
+  checkexit 0 --config="$tmpdir/maxdurations.conf" submit --username=aaaaaa9 --type=quota --ends="$(day "+2 years")" # 13
+  withsettings baddurations '"max_durations": {"queue": "a while"}'
+  checkexit 3 --config="$tmpdir/baddurations.conf" list
+  withsettings baddurations '"max_durations": {"holiday": "3 months"}'
+  checkexit 3 --config="$tmpdir/baddurations.conf" list
+
+  pb "Testing date formats..."
+  withsettings calendar "\"academic_calendar\": {\"terms\": [{\"name\": \"this\", \"starts\": \"$(day "-30 days")\", \"ends\": \"$(day "+30 days")\"}, {\"name\": \"next\", \"starts\": \"$(day "+60 days")\", \"ends\": \"$(day "+120 days")\"}], \"dates\": {\"graduation\": \"2027-07-05\"}}"
+  function lastid() {
+    listids all | awk '{ print $NF }'
+  }
+  # Submits an exception starting on $1 (and ending on $3, if given), and checks it starts on $2 (and ends on $4)
+  function checkdate() {
+    "$EXE" --config="$tmpdir/calendar.conf" submit --username=dddddd1 --force --allow-overlap --starts="$1" --ends="${3:-+1d}" >/dev/null 2>&1 \
+      || { pr "Failed: could not submit with --starts=\"$1\" --ends=\"${3:-+1d}\""; return 1; }
+    local id
+    id="$(lastid)"
+    checkprop "$id" "Starts" "$2"
+    [[ -z "$4" ]] || checkprop "$id" "Ends" "$4"
+  }
+  checkdate 2026-03-01           2026-03-01
+  checkdate 01/03/2026           2026-03-01
+  checkdate "1st March 2026"     2026-03-01
+  checkdate "March 1, 2026"      2026-03-01
+  checkdate today                "$(day today)"
+  checkdate tomorrow             "$(day tomorrow)"
+  checkdate yesterday            "$(day yesterday)"
+  checkdate +90d                 "$(day "+90 days")"
+  checkdate "+90 days"           "$(day "+90 days")"
+  checkdate +2w                  "$(day "+14 days")"
+  checkdate +6m                  "$(day "+6 months")"
+  checkdate +1y                  "$(day "+1 year")"
+  checkdate -10d                 "$(day "-10 days")"
+  checkdate next-monday          "$(day "next monday")"
+  checkdate next-friday          "$(day "next friday")"
+  checkdate start-of-term        "$(day "-30 days")"
+  checkdate end-of-term          "$(day "+30 days")"
+  checkdate start-of-next-term   "$(day "+60 days")"
+  checkdate graduation           2027-07-05
+  checkdate 2026-01-31           2026-01-31 +1m 2026-03-03 # Relative end dates count from the start
+  checkdate 2026-03-01           2026-03-01 end-of-term "$(day "+30 days")"
+  checkexit 6 submit --username=dddddd1 --starts=soon
+  checkexit 6 submit --username=dddddd1 --starts=+6x
+  checkexit 6 submit --username=dddddd1 --starts=end-of-term # No calendar in this config
+  withsettings badcalendar '"academic_calendar": {"terms": [{"name": "autumn", "starts": "2026-12-11", "ends": "2026-09-28"}]}'
+  checkexit 3 --config="$tmpdir/badcalendar.conf" list
+  pb "Testing time zones and clock changes..."
+  # In London, the clocks go forward at 01:00 UTC on 2026-03-29, and back at 01:00 UTC on 2026-10-25
+  withsettings london '"timezone": "Europe/London"'
+  function london() {
+    "$EXE" --config="$tmpdir/london.conf" "$@"
+  }
+  # Checks what info says is left of exception $1 at time $2
+  function checkremaining() {
+    local remaining
+    remaining="$(london --now="$2" info "$1" | getprop "Remaining")"
+    if [[ "$remaining" != "$3" ]]; then
+      pr "Failed: remaining time of $1 at $2: expected \"$3\", got \"$remaining\""
+      return 1
+    fi
+  }
+  london --now=2026-03-20T12:00:00Z submit --username=tttttt1 --submitted=2026-03-20 --starts=2026-03-20 --ends=2026-03-29
+  spring="$(lastid)"
+  london approve "$spring"; london implemented "$spring"
+  checkremaining "$spring" 2026-03-20T12:00:00Z "9 days"
+  checkremaining "$spring" 2026-03-29T22:30:00Z "last day today" # 23:30 BST on the 29th
+  checkremaining "$spring" 2026-03-29T23:30:00Z "finished"       # 00:30 BST on the 30th
+  [[ " $(london --now=2026-03-29T22:30:00Z list overdue | awk '{ print $1 }' | xargs) " != *" $spring "* ]] \
+    || { pr "Failed: exception $spring should not be overdue on its last day"; false; }
+  [[ " $(london --now=2026-03-29T23:30:00Z list overdue | awk '{ print $1 }' | xargs) " == *" $spring "* ]] \
+    || { pr "Failed: exception $spring should be overdue once its last day is over"; false; }
+  london --now=2026-10-01T12:00:00Z submit --username=tttttt2 --submitted=2026-10-01 --starts=2026-10-01 --ends=2026-10-25
+  autumn="$(lastid)"
+  london approve "$autumn"; london implemented "$autumn"
+  checkremaining "$autumn" 2026-10-24T22:30:00Z "1 day"          # 23:30 BST on the 24th
+  checkremaining "$autumn" 2026-10-24T23:30:00Z "last day today" # 00:30 BST on the 25th
+  checkremaining "$autumn" 2026-10-25T23:30:00Z "last day today" # 23:30 GMT on the 25th
+  checkremaining "$autumn" 2026-10-26T00:30:00Z "finished"
+  london --now=2026-03-29T23:30:00Z submit --username=tttttt3 --allow-overlap
+  checkprop "$(lastid)" "Starts" "2026-03-30"
+  checkprop "$(lastid)" "Ends"   "2027-03-30"
+  # Whatever zone the host is in, dates are the same dates
+  TZ=Pacific/Auckland "$EXE" --now=2026-03-29T12:00:00Z submit --username=tttttt4 --starts=2026-03-29 --ends=today
+  [[ "$(TZ=America/Los_Angeles "$EXE" info "$(lastid)" | getprop "Starts")" == "2026-03-29" ]] \
+    || { pr "Failed: a date submitted in one time zone should be the same date in another"; false; }
+  [[ "$(TZ=America/Los_Angeles "$EXE" info "$(lastid)" | getprop "Ends")" == "2026-03-30" ]] \
+    || { pr "Failed: today should be worked out in the local time zone if none is configured"; false; }
+  checkexit 2 --now=yesterday list
+  withsettings badzone '"timezone": "Europe/Nowhere"'
+  checkexit 3 --config="$tmpdir/badzone.conf" list
+
+  pb "Testing fsck..."
+  checkexit 0 fsck
+  # Importing over the top is a handy way to make a status disagree with its history
+  "$EXE" dumpjson | sed -e 's/"Status": "rejected"/"Status": "approved"/' | "$EXE" importjson
+  checkexit 8 fsck
+  checkexit 0 fsck --fix
+  checkexit 0 fsck
+  [[ "$("$EXE" info 6 | getprop "Status")" == "rejected" ]] || { pr "Failed: fsck --fix did not restore status from history"; false; }
+  [[ "$("$EXE" info 6 | grep -c "^ *Audit")" == "1" ]] || { pr "Failed: fsck --fix did not record an audit entry"; false; }
+
+  pb "Complete."
+  echo "travis_fold:end:test_running"
 }
 
-"$EXE" destroydb
-"$EXE" createdb
-echo "TEST FILE" >"$tmpdir/test_file"
-echo " Submitting..."
-"$EXE" submit --username=BEEP123 --service=none --comment="ABCDEF" --type=special --submitted=2030-01-15 --starts=2030-01-31 --ends=2030-04-04 --form="$tmpdir/test_file"
-echo " Checking username..."; checkprop 1 "Username"  "beep123" # Usernames should force lowercase
-echo " Checking dates...";    checkprop 1 "Submitted" "2030-01-15"
-                              checkprop 1 "Starts"    "2030-01-31" 
-                              checkprop 1 "Ends"      "2030-04-04"
-echo " Checking service...";  checkprop 1 "Service"   "none"
-echo " Checking type...";     checkprop 1 "Type"      "special"
-echo " Checking status...";   checkprop 1 "Status"    "undecided"
-echo " Marking as approved..."
-"$EXE" approve 1
-echo " Marking as implemented..."
-"$EXE" implemented 1
-echo " Checking status updates..."
-[[ "$("$EXE" info 1 | grep -c "Status Change")" == "3" ]]
-[[ $("$EXE" info 1 | getprop "Status") == "implemented" ]]
-echo " Adding comment..."
-"$EXE" comment -c "MNOPQ" 1
-echo " Marking as removed..."
-"$EXE" remove 1
-echo " Checking status updates..."
-[[ "$("$EXE" info 1 | grep -c "Status Change")" == "4" ]]
-[[ $("$EXE" info 1 | getprop "Status") == "removed" ]]
-echo " Checking form attachment..."
-"$EXE" form download-for 1
-diff -q "test_file" "$tmpdir/test_file"
-pb "Complete."
-echo "travis_fold:end:test_running"
+set -o errexit
+for config in "${configs[@]}"; do
+  pb "Using $(basename "$config" .conf) database..."
+  export EXCEPTIONS_CONFIG="$config"
+  run_tests
+done